@@ -0,0 +1,61 @@
+package changestream
+
+import (
+	"time"
+)
+
+const (
+	MinPollInterval = time.Millisecond * 10
+	MaxPollInterval = time.Second
+
+	// backoffFactor is the factor the poll interval grows by for every poll
+	// that finds no changes.
+	backoffFactor = 2
+)
+
+// Backoff decides how long the ChangeStream waits between polls of the
+// change_log.
+type Backoff interface {
+	// Next returns the delay before the next poll, given the number of
+	// changes read by the previous poll.
+	Next(changes int) time.Duration
+}
+
+// AdaptiveBackoff polls at the minimum interval while changes are flowing and
+// doubles the interval, up to the maximum, every time a poll comes back empty.
+type AdaptiveBackoff struct {
+	min, max time.Duration
+	current  time.Duration
+}
+
+func NewAdaptiveBackoff(min, max time.Duration) *AdaptiveBackoff {
+	if max < min {
+		max = min
+	}
+	return &AdaptiveBackoff{
+		min:     min,
+		max:     max,
+		current: min,
+	}
+}
+
+func (b *AdaptiveBackoff) Next(changes int) time.Duration {
+	if changes > 0 {
+		b.current = b.min
+		return b.current
+	}
+
+	next := b.current * backoffFactor
+	if next > b.max || next <= 0 {
+		next = b.max
+	}
+	b.current = next
+	return b.current
+}
+
+// ConstantBackoff always polls at the same interval.
+type ConstantBackoff time.Duration
+
+func (b ConstantBackoff) Next(int) time.Duration {
+	return time.Duration(b)
+}
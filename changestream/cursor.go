@@ -0,0 +1,119 @@
+package changestream
+
+import (
+	"database/sql"
+
+	"github.com/juju/errors"
+)
+
+type startKind int
+
+const (
+	startFromID startKind = iota
+	startFromNow
+	startFromStored
+)
+
+// StartPosition defines where in the change_log a ChangeStream starts
+// reading from.
+type StartPosition struct {
+	kind startKind
+	id   int64
+}
+
+// StartFromID starts the stream with the first change after the given ID. The
+// stream fails to start if the changes after it have been pruned.
+func StartFromID(id int64) StartPosition {
+	return StartPosition{kind: startFromID, id: id}
+}
+
+// StartFromNow skips every change already in the change_log.
+func StartFromNow() StartPosition {
+	return StartPosition{kind: startFromNow}
+}
+
+// StartFromStored resumes from the cursor persisted for the stream. If no
+// cursor has been persisted yet, the stream starts from now. The stream fails
+// to start if the changes after the cursor have been pruned, as they are when
+// the node has been gone for longer than the pruner keeps its cursor live.
+func StartFromStored() StartPosition {
+	return StartPosition{kind: startFromStored}
+}
+
+const (
+	cursorQuery  = "SELECT cursor_id FROM change_log_cursor WHERE node_id = ? AND stream = ?"
+	cursorUpsert = `
+INSERT INTO change_log_cursor (node_id, stream, cursor_id, updated_at) VALUES (?, ?, ?, DATETIME('now'))
+	ON CONFLICT(node_id, stream) DO UPDATE SET cursor_id=excluded.cursor_id, updated_at=excluded.updated_at
+`
+	headQuery = "SELECT COALESCE(MAX(id), 0) FROM change_log"
+)
+
+// cursorStore persists the position of a named stream on a given node, so
+// that a restarted node can resume where it left off.
+type cursorStore struct {
+	db     *sql.DB
+	nodeID string
+	stream string
+}
+
+func (s cursorStore) enabled() bool {
+	return s.nodeID != "" && s.stream != ""
+}
+
+func (s cursorStore) load() (int64, bool, error) {
+	var id int64
+	if err := s.db.QueryRow(cursorQuery, s.nodeID, s.stream).Scan(&id); err == sql.ErrNoRows {
+		return 0, false, nil
+	} else if err != nil {
+		return 0, false, errors.Annotatef(err, "loading cursor for %q on node %q", s.stream, s.nodeID)
+	}
+	return id, true, nil
+}
+
+func (s cursorStore) save(id int64) error {
+	if _, err := s.db.Exec(cursorUpsert, s.nodeID, s.stream, id); err != nil {
+		return errors.Annotatef(err, "saving cursor for %q on node %q", s.stream, s.nodeID)
+	}
+	return nil
+}
+
+func (w *ChangeStream) resolveStart(start StartPosition) (int64, error) {
+	switch start.kind {
+	case startFromStored:
+		if !w.cursors.enabled() {
+			return 0, errors.NotValidf("starting from a stored cursor without a durable cursor")
+		}
+		id, found, err := w.cursors.load()
+		if err != nil {
+			return 0, err
+		}
+		if found {
+			return w.checkStart(id)
+		}
+		fallthrough
+	case startFromNow:
+		var id int64
+		if err := w.db.QueryRow(headQuery).Scan(&id); err != nil {
+			return 0, errors.Annotate(err, "reading change_log head")
+		}
+		return id, nil
+	default:
+		return w.checkStart(start.id)
+	}
+}
+
+// checkStart refuses to start after a change ID if the changes after it have
+// been pruned, such as when a node has been down for longer than the pruner
+// considers its cursor live; starting anyway would silently skip them.
+func (w *ChangeStream) checkStart(id int64) (int64, error) {
+	// Starting from the very beginning, the default, reads whatever the
+	// change_log still has.
+	if id == 0 {
+		return 0, nil
+	}
+	if err := checkNotPruned(w.db, id); err != nil {
+		return 0, errors.Annotatef(err, "starting change stream after %d", id)
+	}
+	return id, nil
+}
@@ -0,0 +1,129 @@
+package changestream
+
+import (
+	"time"
+
+	"github.com/juju/clock"
+)
+
+const (
+	DefaultGapGracePeriod = time.Second * 5
+)
+
+// gap is a run of change_log IDs missing from a poll. A gap is either a
+// transaction that hasn't committed yet, or one that was rolled back.
+type gap struct {
+	from, to int64
+	since    time.Time
+}
+
+// gapTracker keeps track of the change_log IDs read above the watermark, so
+// that the watermark is only moved past a missing ID once it has been read,
+// or once it has been missing for longer than the grace period.
+type gapTracker struct {
+	clock  clock.Clock
+	grace  time.Duration
+	logger Logger
+
+	watermark int64
+	// highest is the highest ID read, new changes are read after it.
+	highest int64
+	seen    map[int64]struct{}
+	gaps    []gap
+}
+
+func newGapTracker(clock clock.Clock, grace time.Duration, logger Logger) *gapTracker {
+	return &gapTracker{
+		clock:  clock,
+		grace:  grace,
+		logger: logger,
+		seen:   make(map[int64]struct{}),
+	}
+}
+
+func (t *gapTracker) reset(watermark int64) {
+	t.watermark = watermark
+	t.highest = watermark
+	t.seen = make(map[int64]struct{})
+	t.gaps = nil
+}
+
+// open returns the gaps still waiting for their IDs to be read.
+func (t *gapTracker) open() []gap {
+	return t.gaps
+}
+
+// observe records the new IDs read by a poll. The IDs are expected to be
+// sorted and above the highest ID read so far.
+func (t *gapTracker) observe(ids []int64) {
+	if len(ids) == 0 {
+		return
+	}
+
+	now := t.clock.Now()
+
+	prev := t.highest
+	for _, id := range ids {
+		t.seen[id] = struct{}{}
+
+		if id > prev+1 {
+			t.gaps = append(t.gaps, gap{
+				from:  prev + 1,
+				to:    id - 1,
+				since: now,
+			})
+		}
+		prev = id
+	}
+	t.highest = prev
+}
+
+// fill records the IDs read from within the open gaps, splitting the gaps
+// around them. The IDs are expected to be sorted.
+func (t *gapTracker) fill(ids []int64) {
+	if len(ids) == 0 {
+		return
+	}
+
+	var gaps []gap
+	for _, g := range t.gaps {
+		from := g.from
+		for _, id := range ids {
+			if id < g.from || id > g.to {
+				continue
+			}
+			t.seen[id] = struct{}{}
+
+			if id > from {
+				gaps = append(gaps, gap{from: from, to: id - 1, since: g.since})
+			}
+			from = id + 1
+		}
+		if from <= g.to {
+			gaps = append(gaps, gap{from: from, to: g.to, since: g.since})
+		}
+	}
+	t.gaps = gaps
+}
+
+// advance moves the watermark past every contiguous ID that has been read,
+// and past any gap that has outlived the grace period.
+func (t *gapTracker) advance() int64 {
+	for {
+		next := t.watermark + 1
+		if _, ok := t.seen[next]; ok {
+			delete(t.seen, next)
+			t.watermark = next
+			continue
+		}
+
+		if len(t.gaps) > 0 && t.gaps[0].from == next && t.clock.Now().Sub(t.gaps[0].since) >= t.grace {
+			t.logger.Debugf("skipping change_log IDs %d to %d, missing for longer than %v", t.gaps[0].from, t.gaps[0].to, t.grace)
+			t.watermark = t.gaps[0].to
+			t.gaps = t.gaps[1:]
+			continue
+		}
+
+		return t.watermark
+	}
+}
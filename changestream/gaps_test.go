@@ -0,0 +1,145 @@
+package changestream
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/juju/clock/testclock"
+)
+
+type testLogger struct {
+	t *testing.T
+}
+
+func (l testLogger) Errorf(format string, args ...interface{}) {
+	l.t.Logf("ERROR "+format, args...)
+}
+
+func (l testLogger) Debugf(format string, args ...interface{}) {
+	l.t.Logf("DEBUG "+format, args...)
+}
+
+const testGrace = 5 * time.Second
+
+// gapStep is something happening to a gap tracker, and what it should make of
+// it.
+type gapStep struct {
+	observe []int64
+	fill    []int64
+	wait    time.Duration
+
+	watermark int64
+	gaps      [][2]int64
+}
+
+func TestGapTracker(t *testing.T) {
+	tests := []struct {
+		name  string
+		steps []gapStep
+	}{{
+		name: "contiguous",
+		steps: []gapStep{
+			{observe: []int64{1, 2, 3}, watermark: 3},
+			{observe: []int64{4}, watermark: 4},
+		},
+	}, {
+		name: "gap filled",
+		steps: []gapStep{
+			{observe: []int64{1, 3}, watermark: 1, gaps: [][2]int64{{2, 2}}},
+			{fill: []int64{2}, watermark: 3},
+		},
+	}, {
+		name: "gap filled out of order",
+		steps: []gapStep{
+			{observe: []int64{1, 5}, watermark: 1, gaps: [][2]int64{{2, 4}}},
+			{fill: []int64{4}, watermark: 1, gaps: [][2]int64{{2, 3}}},
+			{fill: []int64{3}, watermark: 1, gaps: [][2]int64{{2, 2}}},
+			{fill: []int64{2}, watermark: 5},
+		},
+	}, {
+		name: "gap split by fill",
+		steps: []gapStep{
+			{observe: []int64{1, 6}, watermark: 1, gaps: [][2]int64{{2, 5}}},
+			{fill: []int64{3, 4}, watermark: 1, gaps: [][2]int64{{2, 2}, {5, 5}}},
+			{fill: []int64{2}, watermark: 4, gaps: [][2]int64{{5, 5}}},
+			{fill: []int64{5}, watermark: 6},
+		},
+	}, {
+		name: "gap expires after grace period",
+		steps: []gapStep{
+			{observe: []int64{1, 3}, watermark: 1, gaps: [][2]int64{{2, 2}}},
+			{wait: testGrace - time.Millisecond, watermark: 1, gaps: [][2]int64{{2, 2}}},
+			{wait: time.Millisecond, watermark: 3},
+			// A late arrival after the gap was skipped is past the watermark.
+			{fill: []int64{2}, watermark: 3},
+		},
+	}, {
+		name: "split gap keeps when it was first missing",
+		steps: []gapStep{
+			{observe: []int64{1, 5}, watermark: 1, gaps: [][2]int64{{2, 4}}},
+			{wait: testGrace / 2, fill: []int64{3}, watermark: 1, gaps: [][2]int64{{2, 2}, {4, 4}}},
+			{wait: testGrace / 2, watermark: 5},
+		},
+	}, {
+		name: "later gap waits for its own grace period",
+		steps: []gapStep{
+			{observe: []int64{1, 3}, watermark: 1, gaps: [][2]int64{{2, 2}}},
+			{wait: testGrace / 2, observe: []int64{5}, watermark: 1, gaps: [][2]int64{{2, 2}, {4, 4}}},
+			{wait: testGrace / 2, watermark: 3, gaps: [][2]int64{{4, 4}}},
+			{wait: testGrace / 2, watermark: 5},
+		},
+	}, {
+		// With a batch size of 2, the first read stops at 3, inside what
+		// turns out to be a run of changes with a gap in it. The next read
+		// carries on after 3, rather than from the watermark.
+		name: "batch limit inside gap",
+		steps: []gapStep{
+			{observe: []int64{1, 3}, watermark: 1, gaps: [][2]int64{{2, 2}}},
+			{observe: []int64{4, 5}, watermark: 1, gaps: [][2]int64{{2, 2}}},
+			{observe: []int64{7}, watermark: 1, gaps: [][2]int64{{2, 2}, {6, 6}}},
+			{fill: []int64{2}, watermark: 5, gaps: [][2]int64{{6, 6}}},
+		},
+	}}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			clock := testclock.NewClock(time.Now())
+			tracker := newGapTracker(clock, testGrace, testLogger{t})
+			tracker.reset(0)
+
+			for i, step := range test.steps {
+				if step.wait > 0 {
+					clock.Advance(step.wait)
+				}
+				tracker.fill(step.fill)
+				tracker.observe(step.observe)
+
+				if watermark := tracker.advance(); watermark != step.watermark {
+					t.Fatalf("step %d: watermark %d, expected %d", i, watermark, step.watermark)
+				}
+				var gaps [][2]int64
+				for _, g := range tracker.open() {
+					gaps = append(gaps, [2]int64{g.from, g.to})
+				}
+				if !reflect.DeepEqual(gaps, step.gaps) {
+					t.Fatalf("step %d: gaps %v, expected %v", i, gaps, step.gaps)
+				}
+			}
+		})
+	}
+}
+
+func TestGapTrackerResumesAfterReset(t *testing.T) {
+	clock := testclock.NewClock(time.Now())
+	tracker := newGapTracker(clock, testGrace, testLogger{t})
+	tracker.reset(10)
+
+	tracker.observe([]int64{12})
+	if watermark := tracker.advance(); watermark != 10 {
+		t.Fatalf("watermark %d, expected 10", watermark)
+	}
+	if tracker.highest != 12 {
+		t.Fatalf("highest %d, expected 12", tracker.highest)
+	}
+}
@@ -0,0 +1,278 @@
+package changestream
+
+import (
+	"database/sql"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/SimonRichardson/nu-juju-watchers/db"
+	"github.com/SimonRichardson/nu-juju-watchers/eventqueue"
+	"github.com/juju/clock"
+	"github.com/mattn/go-sqlite3"
+	"gopkg.in/tomb.v2"
+)
+
+// HookStream is an alternative to the ChangeStream for deployments backed by
+// a local sqlite database. Rather than polling the change_log, it is fed by
+// the update, commit and rollback hooks of every connection it is registered
+// with, so committed changes are delivered straight away.
+//
+// The hooks only say which change_log rows a transaction wrote, so the rows
+// are read back once it has committed. The changes are the same as the
+// ChangeStream's, with the same change IDs and entity IDs.
+//
+// The stream must be registered with the driver through its ConnectHook
+// before the database is first used. As sql.Open doesn't connect, the stream
+// can be made from the database it opens:
+//
+//	var stream *changestream.HookStream
+//	sql.Register("sqlite3_hooked", &sqlite3.SQLiteDriver{
+//		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+//			return stream.ConnectHook(conn)
+//		},
+//	})
+//	db, err := sql.Open("sqlite3_hooked", dsn)
+//	...
+//	stream = changestream.NewHookStream(db)
+type HookStream struct {
+	tomb      tomb.Tomb
+	db        *sql.DB
+	clock     clock.Clock
+	batchSize int
+	grace     time.Duration
+	logger    Logger
+	outlet    outlet
+
+	mu sync.Mutex
+	// pending holds the change_log IDs written by the open transaction on
+	// each connection.
+	pending   map[*sqlite3.SQLiteConn][]int64
+	committed []int64
+	notify    chan struct{}
+}
+
+func NewHookStream(db *sql.DB, opts ...Option) *HookStream {
+	o := newOptions()
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	stream := &HookStream{
+		db:        db,
+		clock:     o.clock,
+		batchSize: o.batchSize,
+		grace:     o.gapGracePeriod,
+		logger:    o.logger,
+		outlet:    newOutlet(o.batchDelivery),
+		pending:   make(map[*sqlite3.SQLiteConn][]int64),
+		notify:    make(chan struct{}, 1),
+	}
+
+	stream.tomb.Go(stream.loop)
+	return stream
+}
+
+// ConnectHook registers the stream hooks on a new sqlite connection. It
+// matches the ConnectHook of the sqlite3.SQLiteDriver.
+func (w *HookStream) ConnectHook(conn *sqlite3.SQLiteConn) error {
+	conn.RegisterUpdateHook(func(op int, _ string, table string, rowID int64) {
+		w.onUpdate(conn, op, table, rowID)
+	})
+	conn.RegisterCommitHook(func() int {
+		w.onCommit(conn)
+		// Returning zero lets the commit go ahead.
+		return 0
+	})
+	conn.RegisterRollbackHook(func() {
+		w.onRollback(conn)
+	})
+	return nil
+}
+
+func (w *HookStream) Changes() <-chan eventqueue.Change {
+	return w.outlet.changeCh
+}
+
+// Batches delivers all the changes committed since the last delivery
+// together. It is only delivered to if the stream was created with
+// WithBatchDelivery, in which case Changes is never delivered to.
+func (w *HookStream) Batches() <-chan []eventqueue.Change {
+	return w.outlet.batchCh
+}
+
+// Replay returns every change in the change_log after the change ID, as the
+// ChangeStream does.
+func (w *HookStream) Replay(since int64) ([]eventqueue.Change, error) {
+	return replay(w.db, since, w.batchSize)
+}
+
+func (w *HookStream) Wait() <-chan struct{} {
+	return w.tomb.Dead()
+}
+
+func (w *HookStream) Close() error {
+	w.tomb.Kill(nil)
+	return w.tomb.Wait()
+}
+
+// The hooks are called by sqlite while it holds the connection, so they must
+// never block on the consumers of the stream.
+
+func (w *HookStream) onUpdate(conn *sqlite3.SQLiteConn, op int, table string, rowID int64) {
+	// The change_log says everything about the change, and its rowid is the
+	// change ID.
+	if table != "change_log" || op != sqlite3.SQLITE_INSERT {
+		return
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.pending[conn] = append(w.pending[conn], rowID)
+}
+
+func (w *HookStream) onCommit(conn *sqlite3.SQLiteConn) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	ids := w.pending[conn]
+	delete(w.pending, conn)
+	if len(ids) == 0 {
+		return
+	}
+	w.committed = append(w.committed, ids...)
+
+	select {
+	case w.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (w *HookStream) onRollback(conn *sqlite3.SQLiteConn) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	delete(w.pending, conn)
+}
+
+func (w *HookStream) loop() error {
+	defer w.outlet.close()
+
+	var (
+		// unread are the committed IDs that haven't been read back yet,
+		// and missing is when each of them was first found missing.
+		unread  []int64
+		missing = make(map[int64]time.Time)
+		retry   <-chan time.Time
+	)
+	for {
+		select {
+		case <-w.tomb.Dying():
+			return tomb.ErrDying
+		case <-w.notify:
+		case <-retry:
+		}
+		retry = nil
+
+		w.mu.Lock()
+		unread = append(unread, w.committed...)
+		w.committed = nil
+		w.mu.Unlock()
+		if len(unread) == 0 {
+			continue
+		}
+
+		// Commits can interleave on different connections, so put the
+		// changes back in the order they were made.
+		sort.Slice(unread, func(i, j int) bool {
+			return unread[i] < unread[j]
+		})
+
+		var docs []change
+		err := db.WithRetry(func() error {
+			var err error
+			docs, err = w.read(unread)
+			return err
+		})
+		if err != nil {
+			w.logger.Errorf("%v", err)
+			return err
+		}
+		if err := w.outlet.deliver(w.tomb.Dying(), coalesce(docs)); err != nil {
+			return err
+		}
+
+		// The commit hook is called just before the commit lands, so the
+		// latest rows may not be there to read yet. They're read again
+		// shortly, until they have been missing for the grace period.
+		unread = w.stillMissing(unread, docs, missing)
+		if len(unread) > 0 {
+			retry = w.clock.After(MinPollInterval)
+		}
+	}
+}
+
+const (
+	hookQuery = `
+SELECT id, type, entity_type, entity_id, created_at
+	FROM change_log WHERE id BETWEEN ? AND ?
+	ORDER BY id ASC
+`
+)
+
+// read reads the change_log rows with the IDs, which are sorted.
+func (w *HookStream) read(ids []int64) ([]change, error) {
+	wanted := make(map[int64]struct{}, len(ids))
+	for _, id := range ids {
+		wanted[id] = struct{}{}
+	}
+
+	rows, err := w.db.Query(hookQuery, ids[0], ids[len(ids)-1])
+	if err != nil {
+		return nil, err
+	}
+	docs, err := scanChanges(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	// Rows in between written by connections without the hooks are left to
+	// whoever wrote them.
+	result := docs[:0]
+	for _, doc := range docs {
+		if _, ok := wanted[doc.id]; ok {
+			result = append(result, doc)
+		}
+	}
+	return result, nil
+}
+
+// stillMissing returns the IDs that weren't read, dropping the ones that have
+// been missing for longer than the grace period.
+func (w *HookStream) stillMissing(ids []int64, docs []change, missing map[int64]time.Time) []int64 {
+	read := make(map[int64]struct{}, len(docs))
+	for _, doc := range docs {
+		read[doc.id] = struct{}{}
+	}
+
+	now := w.clock.Now()
+	var result []int64
+	for _, id := range ids {
+		if _, ok := read[id]; ok {
+			delete(missing, id)
+			continue
+		}
+
+		since, ok := missing[id]
+		if !ok {
+			missing[id] = now
+		} else if now.Sub(since) >= w.grace {
+			w.logger.Debugf("skipping change_log ID %d, missing for longer than %v", id, w.grace)
+			delete(missing, id)
+			continue
+		}
+		result = append(result, id)
+	}
+	return result
+}
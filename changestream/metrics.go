@@ -0,0 +1,103 @@
+package changestream
+
+import (
+	"database/sql"
+	"sync"
+	"time"
+
+	"github.com/SimonRichardson/nu-juju-watchers/db"
+	"github.com/SimonRichardson/nu-juju-watchers/metrics"
+	"github.com/juju/errors"
+)
+
+// pollStats keeps track of the polls made by the stream, so that they can be
+// scraped from another goroutine.
+type pollStats struct {
+	mu     sync.Mutex
+	counts pollCounts
+}
+
+type pollCounts struct {
+	cursor            int64
+	polls             uint64
+	rows              uint64
+	lastRows          int
+	retries           uint64
+	lastPollDuration  time.Duration
+	totalPollDuration time.Duration
+}
+
+func (s *pollStats) setCursor(cursor int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.counts.cursor = cursor
+}
+
+func (s *pollStats) recordPoll(duration time.Duration, rows, retries int, cursor int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.counts.cursor = cursor
+	s.counts.polls++
+	s.counts.rows += uint64(rows)
+	s.counts.lastRows = rows
+	s.counts.retries += uint64(retries)
+	s.counts.lastPollDuration = duration
+	s.counts.totalPollDuration += duration
+}
+
+func (s *pollStats) snapshot() pollCounts {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.counts
+}
+
+const (
+	lagQuery = `
+SELECT COUNT(*), MIN(created_at), (SELECT COALESCE(MAX(id), 0) FROM change_log)
+	FROM change_log WHERE id > ?
+`
+)
+
+// Collect writes out how far behind the change_log the stream is, along with
+// the stats of its polls.
+func (w *ChangeStream) Collect(mw *metrics.Writer) error {
+	stats := w.stats.snapshot()
+
+	var (
+		lagRows int64
+		oldest  timestamp
+		head    int64
+	)
+	err := db.WithRetry(func() error {
+		return w.db.QueryRow(lagQuery, stats.cursor).Scan(&lagRows, &oldest, &head)
+	})
+	if err != nil && err != sql.ErrNoRows {
+		return errors.Annotate(err, "reading change_log lag")
+	}
+
+	var lagSeconds float64
+	if lagRows > 0 && !oldest.IsZero() {
+		lagSeconds = w.clock.Now().Sub(oldest.Time).Seconds()
+	}
+
+	mw.Gauge("changestream_cursor", "The change_log ID the stream has read up to.", float64(stats.cursor))
+	mw.Gauge("changestream_head", "The highest ID in the change_log.", float64(head))
+	mw.Gauge("changestream_lag_rows", "The number of change_log rows the stream has yet to read.", float64(lagRows))
+	mw.Gauge("changestream_lag_seconds", "The age of the oldest change_log row the stream has yet to read.", lagSeconds)
+	mw.Counter("changestream_polls_total", "The number of polls of the change_log.", float64(stats.polls))
+	mw.Gauge("changestream_poll_duration_seconds", "The duration of the last poll of the change_log.", stats.lastPollDuration.Seconds())
+	mw.Counter("changestream_poll_duration_seconds_total", "The time spent polling the change_log.", stats.totalPollDuration.Seconds())
+	mw.Gauge("changestream_poll_rows", "The number of changes read by the last poll.", float64(stats.lastRows))
+	mw.Counter("changestream_rows_total", "The number of changes read from the change_log.", float64(stats.rows))
+	mw.Counter("changestream_poll_retries_total", "The number of retried polls of the change_log.", float64(stats.retries))
+	return mw.Err()
+}
+
+// Collect writes out the number of rows removed from the change_log.
+func (p *Pruner) Collect(mw *metrics.Writer) error {
+	mw.Counter("changestream_pruned_rows_total", "The number of rows pruned from the change_log.", float64(p.Removed()))
+	return mw.Err()
+}
@@ -0,0 +1,116 @@
+package changestream
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/juju/clock"
+)
+
+const (
+	DefaultBatchSize = 1000
+)
+
+// Logger is the logging interface used by the ChangeStream.
+type Logger interface {
+	Errorf(format string, args ...interface{})
+	Debugf(format string, args ...interface{})
+}
+
+type Option func(*options)
+
+type options struct {
+	clock          clock.Clock
+	backoff        Backoff
+	start          StartPosition
+	nodeID         string
+	name           string
+	batchSize      int
+	batchDelivery  bool
+	gapGracePeriod time.Duration
+	logger         Logger
+}
+
+func newOptions() *options {
+	return &options{
+		clock:          clock.WallClock,
+		backoff:        NewAdaptiveBackoff(MinPollInterval, MaxPollInterval),
+		batchSize:      DefaultBatchSize,
+		gapGracePeriod: DefaultGapGracePeriod,
+		logger:         stdoutLogger{},
+	}
+}
+
+// WithClock sets the clock used to schedule polls of the change_log.
+func WithClock(clock clock.Clock) Option {
+	return func(o *options) {
+		o.clock = clock
+	}
+}
+
+// WithBackoff sets the policy deciding how long to wait between polls.
+func WithBackoff(backoff Backoff) Option {
+	return func(o *options) {
+		o.backoff = backoff
+	}
+}
+
+// WithPollInterval polls the change_log at a fixed interval, instead of
+// adapting the interval to the flow of changes.
+func WithPollInterval(interval time.Duration) Option {
+	return WithBackoff(ConstantBackoff(interval))
+}
+
+// WithStart sets where in the change_log the stream starts reading from.
+func WithStart(start StartPosition) Option {
+	return func(o *options) {
+		o.start = start
+	}
+}
+
+// WithDurableCursor persists the position of the stream, under the given
+// node ID and stream name, every time it moves forward.
+func WithDurableCursor(nodeID, name string) Option {
+	return func(o *options) {
+		o.nodeID = nodeID
+		o.name = name
+	}
+}
+
+// WithBatchSize limits the number of changes read from the change_log in a
+// single poll.
+func WithBatchSize(size int) Option {
+	return func(o *options) {
+		o.batchSize = size
+	}
+}
+
+// WithBatchDelivery delivers the changes read by each poll together on the
+// Batches channel, instead of one at a time on the Changes channel.
+func WithBatchDelivery() Option {
+	return func(o *options) {
+		o.batchDelivery = true
+	}
+}
+
+// WithGapGracePeriod sets how long a missing change_log ID is waited on, before
+// the stream gives up on it ever being committed.
+func WithGapGracePeriod(grace time.Duration) Option {
+	return func(o *options) {
+		o.gapGracePeriod = grace
+	}
+}
+
+func WithLogger(logger Logger) Option {
+	return func(o *options) {
+		o.logger = logger
+	}
+}
+
+type stdoutLogger struct{}
+
+func (stdoutLogger) Errorf(format string, args ...interface{}) {
+	fmt.Printf("ChangeStream err "+format+"\n", args...)
+}
+
+func (stdoutLogger) Debugf(string, ...interface{}) {}
@@ -0,0 +1,57 @@
+package changestream
+
+import (
+	"github.com/SimonRichardson/nu-juju-watchers/eventqueue"
+	"gopkg.in/tomb.v2"
+)
+
+// outlet delivers the changes of a stream, either one at a time or a batch at
+// a time.
+type outlet struct {
+	changeCh chan eventqueue.Change
+	batchCh  chan []eventqueue.Change
+	batched  bool
+}
+
+func newOutlet(batched bool) outlet {
+	return outlet{
+		changeCh: make(chan eventqueue.Change),
+		batchCh:  make(chan []eventqueue.Change),
+		batched:  batched,
+	}
+}
+
+func (o outlet) deliver(dying <-chan struct{}, changes []change) error {
+	if o.batched {
+		if len(changes) == 0 {
+			return nil
+		}
+
+		batch := make([]eventqueue.Change, len(changes))
+		for i, chDoc := range changes {
+			batch[i] = chDoc
+		}
+		select {
+		case o.batchCh <- batch:
+			// done
+		case <-dying:
+			return tomb.ErrDying
+		}
+		return nil
+	}
+
+	for _, chDoc := range changes {
+		select {
+		case o.changeCh <- chDoc:
+			// done
+		case <-dying:
+			return tomb.ErrDying
+		}
+	}
+	return nil
+}
+
+func (o outlet) close() {
+	close(o.changeCh)
+	close(o.batchCh)
+}
@@ -0,0 +1,277 @@
+package changestream
+
+import (
+	"database/sql"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/SimonRichardson/nu-juju-watchers/db"
+	"github.com/juju/clock"
+	"github.com/juju/errors"
+	"gopkg.in/tomb.v2"
+)
+
+const (
+	DefaultPruneInterval  = time.Minute
+	DefaultCursorLiveness = time.Minute * 5
+)
+
+// PrunerOption configures a Pruner.
+type PrunerOption func(*prunerOptions)
+
+type prunerOptions struct {
+	clock    clock.Clock
+	interval time.Duration
+	liveness time.Duration
+	maxAge   time.Duration
+	maxRows  int64
+	isLeader func() (bool, error)
+	logger   Logger
+}
+
+func newPrunerOptions() *prunerOptions {
+	return &prunerOptions{
+		clock:    clock.WallClock,
+		interval: DefaultPruneInterval,
+		liveness: DefaultCursorLiveness,
+		isLeader: func() (bool, error) { return true, nil },
+		logger:   stdoutLogger{},
+	}
+}
+
+func WithPrunerClock(clock clock.Clock) PrunerOption {
+	return func(o *prunerOptions) {
+		o.clock = clock
+	}
+}
+
+// WithPruneInterval sets how often the change_log is pruned.
+func WithPruneInterval(interval time.Duration) PrunerOption {
+	return func(o *prunerOptions) {
+		o.interval = interval
+	}
+}
+
+// WithCursorLiveness sets how recently a stream must have stored its cursor
+// for it to hold back pruning. Cursors that haven't been updated for longer
+// are considered to belong to streams that are no longer running.
+func WithCursorLiveness(liveness time.Duration) PrunerOption {
+	return func(o *prunerOptions) {
+		o.liveness = liveness
+	}
+}
+
+// WithMaxAge removes changes older than the given age, even if a live stream
+// hasn't read them yet.
+func WithMaxAge(age time.Duration) PrunerOption {
+	return func(o *prunerOptions) {
+		o.maxAge = age
+	}
+}
+
+// WithMaxRows caps the change_log at the given number of rows, even if a live
+// stream hasn't read the oldest ones yet.
+func WithMaxRows(rows int64) PrunerOption {
+	return func(o *prunerOptions) {
+		o.maxRows = rows
+	}
+}
+
+// WithLeaderCheck sets the function used to decide if this node should prune
+// the change_log. Only one node in the cluster is expected to return true.
+func WithLeaderCheck(isLeader func() (bool, error)) PrunerOption {
+	return func(o *prunerOptions) {
+		o.isLeader = isLeader
+	}
+}
+
+func WithPrunerLogger(logger Logger) PrunerOption {
+	return func(o *prunerOptions) {
+		o.logger = logger
+	}
+}
+
+// Pruner periodically removes the changes from the change_log that every live
+// stream has already read.
+type Pruner struct {
+	tomb    tomb.Tomb
+	db      *sql.DB
+	opts    *prunerOptions
+	removed int64
+}
+
+func NewPruner(db *sql.DB, opts ...PrunerOption) *Pruner {
+	o := newPrunerOptions()
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	pruner := &Pruner{
+		db:   db,
+		opts: o,
+	}
+
+	pruner.tomb.Go(pruner.loop)
+	return pruner
+}
+
+// Removed returns the total number of rows removed by the pruner.
+func (p *Pruner) Removed() int64 {
+	return atomic.LoadInt64(&p.removed)
+}
+
+func (p *Pruner) Wait() <-chan struct{} {
+	return p.tomb.Dead()
+}
+
+func (p *Pruner) Close() error {
+	p.tomb.Kill(nil)
+	return p.tomb.Wait()
+}
+
+func (p *Pruner) loop() error {
+	timer := p.opts.clock.NewTimer(p.opts.interval)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-p.tomb.Dying():
+			return tomb.ErrDying
+		case <-timer.Chan():
+			leader, err := p.opts.isLeader()
+			if err != nil {
+				// Leadership can move around, try again next time.
+				p.opts.logger.Errorf("checking pruner leadership: %v", err)
+			} else if leader {
+				if _, err := p.Prune(); err != nil {
+					p.opts.logger.Errorf("%v", err)
+					return err
+				}
+			}
+			timer.Reset(p.opts.interval)
+		}
+	}
+}
+
+const (
+	pruneLowWatermarkQuery = "SELECT MIN(cursor_id) FROM change_log_cursor WHERE updated_at > DATETIME('now', ?)"
+	pruneToCursor          = "DELETE FROM change_log WHERE id <= ?"
+	pruneByAge             = "DELETE FROM change_log WHERE created_at < DATETIME('now', ?)"
+	pruneByRows            = "DELETE FROM change_log WHERE id < (SELECT id FROM change_log ORDER BY id DESC LIMIT 1 OFFSET ?)"
+)
+
+// Prune removes every change read by all the live streams, along with
+// anything beyond the age and row caps. It returns the number of rows
+// removed.
+func (p *Pruner) Prune() (int64, error) {
+	var removed int64
+	err := db.WithRetry(func() error {
+		var err error
+		removed, err = p.prune()
+		return err
+	})
+	if err != nil {
+		return 0, errors.Annotate(err, "pruning change_log")
+	}
+
+	atomic.AddInt64(&p.removed, removed)
+	p.opts.logger.Debugf("pruned %d rows from the change_log", removed)
+	return removed, nil
+}
+
+func (p *Pruner) prune() (int64, error) {
+	txn, err := p.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = txn.Rollback() }()
+
+	var removed int64
+	exec := func(query string, args ...interface{}) error {
+		res, err := txn.Exec(query, args...)
+		if err != nil {
+			return err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		removed += n
+		return nil
+	}
+
+	// Without any live streams there is nothing to tell us what has been read,
+	// so only the safety valves apply.
+	var watermark sql.NullInt64
+	if err := txn.QueryRow(pruneLowWatermarkQuery, sqliteModifier(p.opts.liveness)).Scan(&watermark); err != nil {
+		return 0, err
+	}
+	if watermark.Valid {
+		if err := exec(pruneToCursor, watermark.Int64); err != nil {
+			return 0, err
+		}
+	}
+
+	if p.opts.maxAge > 0 {
+		if err := exec(pruneByAge, sqliteModifier(p.opts.maxAge)); err != nil {
+			return 0, err
+		}
+	}
+	if p.opts.maxRows > 0 {
+		if err := exec(pruneByRows, p.opts.maxRows-1); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := txn.Commit(); err != nil {
+		return 0, err
+	}
+	return removed, nil
+}
+
+// sqliteModifier returns a DATETIME modifier going back by the given
+// duration.
+func sqliteModifier(d time.Duration) string {
+	return fmt.Sprintf("-%d seconds", int64(d/time.Second))
+}
+
+const (
+	prunedQuery = `
+SELECT
+	(SELECT MIN(id) FROM change_log),
+	COALESCE(
+		(SELECT seq FROM sqlite_sequence WHERE name = 'change_log'),
+		(SELECT MAX(id) FROM change_log),
+		0
+	)
+`
+)
+
+// checkNotPruned returns an error if any of the changes after the change ID
+// have been pruned. Once every stream has caught up, the pruner can leave the
+// change_log empty, so the highest ID ever written is what tells whether there
+// were changes after it at all.
+func checkNotPruned(sqlDB *sql.DB, since int64) error {
+	var (
+		oldest  sql.NullInt64
+		highest int64
+	)
+	if err := sqlDB.QueryRow(prunedQuery).Scan(&oldest, &highest); err != nil {
+		return errors.Annotate(err, "reading change_log bounds")
+	}
+	if highest <= since {
+		return nil
+	}
+	// The pruner only ever removes the oldest changes, so if the oldest one
+	// left is still within reach, nothing was missed.
+	if oldest.Valid && oldest.Int64 <= since+1 {
+		return nil
+	}
+
+	last := highest
+	if oldest.Valid {
+		last = oldest.Int64 - 1
+	}
+	return errors.Errorf("changes %d to %d have been pruned", since+1, last)
+}
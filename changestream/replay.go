@@ -0,0 +1,78 @@
+package changestream
+
+import (
+	"database/sql"
+
+	"github.com/SimonRichardson/nu-juju-watchers/db"
+	"github.com/SimonRichardson/nu-juju-watchers/eventqueue"
+	"github.com/juju/errors"
+)
+
+const (
+	replayQuery = `
+SELECT id, type, entity_type, entity_id, created_at
+	FROM change_log WHERE id > ?
+	ORDER BY id ASC
+	LIMIT ?
+`
+)
+
+// Replay returns every change in the change_log after the change ID, in the
+// order they were made. Unlike the stream, the changes aren't coalesced, so
+// each one can be matched to the change read by the stream later on. The
+// change_log is read a batch at a time, so a long replay never holds a read
+// open for long.
+//
+// It fails if the pruner has removed some of the changes.
+func (w *ChangeStream) Replay(since int64) ([]eventqueue.Change, error) {
+	return replay(w.db, since, w.batchSize)
+}
+
+func replay(sqlDB *sql.DB, since int64, batchSize int) ([]eventqueue.Change, error) {
+	changes, err := readReplay(sqlDB, since, batchSize)
+	if err != nil {
+		return nil, errors.Annotatef(err, "replaying change_log since %d", since)
+	}
+	return changes, nil
+}
+
+func readReplay(sqlDB *sql.DB, since int64, batchSize int) ([]eventqueue.Change, error) {
+	limit := batchSize
+	if limit <= 0 {
+		limit = -1
+	}
+
+	var changes []eventqueue.Change
+	for last := since; ; {
+		var docs []change
+		err := db.WithRetry(func() error {
+			rows, err := sqlDB.Query(replayQuery, last, limit)
+			if err != nil {
+				return err
+			}
+			docs, err = scanChanges(rows)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		for _, doc := range docs {
+			changes = append(changes, doc)
+			last = doc.id
+		}
+		if limit < 0 || len(docs) < limit {
+			break
+		}
+	}
+
+	// The changes are read before checking, so any pruned while they were
+	// being read are caught too.
+	err := db.WithRetry(func() error {
+		return checkNotPruned(sqlDB, since)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return changes, nil
+}
@@ -2,24 +2,29 @@ package changestream
 
 import (
 	"database/sql"
-	"fmt"
+	"sort"
 	"time"
 
 	"github.com/SimonRichardson/nu-juju-watchers/db"
 	"github.com/SimonRichardson/nu-juju-watchers/eventqueue"
+	"github.com/juju/clock"
 	"gopkg.in/tomb.v2"
 )
 
 const (
-	ChangePollInterval = time.Millisecond * 100
+	CursorHeartbeatInterval = time.Minute
 )
 
 type change struct {
-	id         int
+	id         int64
 	changeType eventqueue.ChangeType
 	entityType string
-	entityID   int64
-	createdAt  string
+	entityID   string
+	createdAt  timestamp
+}
+
+func (c change) ChangeID() int64 {
+	return c.id
 }
 
 func (c change) Type() eventqueue.ChangeType {
@@ -30,21 +35,50 @@ func (c change) EntityType() string {
 	return c.entityType
 }
 
-func (c change) EntityID() int64 {
+func (c change) EntityID() string {
 	return c.entityID
 }
 
+func (c change) Timestamp() time.Time {
+	return c.createdAt.Time
+}
+
 type ChangeStream struct {
-	tomb     tomb.Tomb
-	db       *sql.DB
-	changeCh chan eventqueue.Change
-	lastId   int
+	tomb        tomb.Tomb
+	db          *sql.DB
+	clock       clock.Clock
+	backoff     Backoff
+	batchSize   int
+	logger      Logger
+	start       StartPosition
+	cursors     cursorStore
+	cursorSaved time.Time
+	gaps        *gapTracker
+	outlet      outlet
+	stats       pollStats
+	lastId      int64
 }
 
-func New(db *sql.DB) *ChangeStream {
+func New(db *sql.DB, opts ...Option) *ChangeStream {
+	o := newOptions()
+	for _, opt := range opts {
+		opt(o)
+	}
+
 	stream := &ChangeStream{
-		db:       db,
-		changeCh: make(chan eventqueue.Change),
+		db:        db,
+		clock:     o.clock,
+		backoff:   o.backoff,
+		batchSize: o.batchSize,
+		logger:    o.logger,
+		start:     o.start,
+		cursors: cursorStore{
+			db:     db,
+			nodeID: o.nodeID,
+			stream: o.name,
+		},
+		gaps:   newGapTracker(o.clock, o.gapGracePeriod, o.logger),
+		outlet: newOutlet(o.batchDelivery),
 	}
 
 	stream.tomb.Go(stream.loop)
@@ -52,7 +86,14 @@ func New(db *sql.DB) *ChangeStream {
 }
 
 func (w *ChangeStream) Changes() <-chan eventqueue.Change {
-	return w.changeCh
+	return w.outlet.changeCh
+}
+
+// Batches delivers all the changes read by a single poll together. It is only
+// delivered to if the stream was created with WithBatchDelivery, in which case
+// Changes is never delivered to.
+func (w *ChangeStream) Batches() <-chan []eventqueue.Change {
+	return w.outlet.batchCh
 }
 
 func (w *ChangeStream) Wait() <-chan struct{} {
@@ -65,43 +106,141 @@ func (w *ChangeStream) Close() error {
 }
 
 func (w *ChangeStream) loop() error {
-	defer close(w.changeCh)
+	defer w.outlet.close()
 
-	// Wait for 100 milliseconds for a change
-	timer := time.NewTimer(ChangePollInterval)
+	err := db.WithRetry(func() error {
+		var err error
+		w.lastId, err = w.resolveStart(w.start)
+		return err
+	})
+	if err != nil {
+		w.logger.Errorf("%v", err)
+		return err
+	}
+	w.gaps.reset(w.lastId)
+	w.stats.setCursor(w.lastId)
+
+	// Poll straight away, after that the backoff decides how long we wait
+	// between polls.
+	timer := w.clock.NewTimer(0)
 	defer timer.Stop()
 
 	for {
 		select {
 		case <-w.tomb.Dying():
 			return tomb.ErrDying
-		case <-timer.C:
-			if err := db.WithRetry(w.read); err != nil {
-				fmt.Println("ChangeStream err", err)
+		case <-timer.Chan():
+			var n, attempts int
+			started := w.clock.Now()
+			err := db.WithRetry(func() error {
+				attempts++
+				var err error
+				n, err = w.read()
+				return err
+			})
+			if err != nil {
+				w.logger.Errorf("%v", err)
 				return err
 			}
-			// TODO: We should make this adaptive.
-			timer.Reset(ChangePollInterval)
+			w.stats.recordPoll(w.clock.Now().Sub(started), n, attempts-1, w.lastId)
+			if err := w.saveCursor(n); err != nil {
+				w.logger.Errorf("%v", err)
+				return err
+			}
+			timer.Reset(w.backoff.Next(n))
 		}
 	}
 }
 
+// saveCursor persists the cursor when it has moved. An idle stream still
+// refreshes its cursor every CursorHeartbeatInterval, so the pruner knows it
+// is alive.
+func (w *ChangeStream) saveCursor(changes int) error {
+	if !w.cursors.enabled() {
+		return nil
+	}
+
+	now := w.clock.Now()
+	if changes == 0 && now.Sub(w.cursorSaved) < CursorHeartbeatInterval {
+		return nil
+	}
+
+	if err := db.WithRetry(func() error { return w.cursors.save(w.lastId) }); err != nil {
+		return err
+	}
+	w.cursorSaved = now
+	return nil
+}
+
 const (
 	query = `
-SELECT MAX(id), type, entity_type, entity_id, MAX(created_at)
+SELECT id, type, entity_type, entity_id, created_at
 	FROM change_log WHERE id > ?
-	GROUP BY type, entity_type, entity_id 
+	ORDER BY id ASC
+	LIMIT ?
+`
+	gapQuery = `
+SELECT id, type, entity_type, entity_id, created_at
+	FROM change_log WHERE id BETWEEN ? AND ?
 	ORDER BY id ASC
 `
 )
 
-func (w *ChangeStream) read() error {
-	// We want to last known Id we've scanned and everything after we've started
-	// to subscribe.
-	rows, err := w.db.Query(query, w.lastId)
+func (w *ChangeStream) read() (int, error) {
+	// New changes are read after the highest ID read so far, so a gap held
+	// open never holds back the changes committed after it.
+	limit := w.batchSize
+	if limit <= 0 {
+		limit = -1
+	}
+	rows, err := w.db.Query(query, w.gaps.highest, limit)
 	if err != nil {
-		return err
+		return 0, err
+	}
+	docs, err := scanChanges(rows)
+	if err != nil {
+		return 0, err
+	}
+
+	// Only the open gaps are read again, for the transactions that have
+	// committed since.
+	var filled []change
+	for _, g := range w.gaps.open() {
+		rows, err := w.db.Query(gapQuery, g.from, g.to)
+		if err != nil {
+			return 0, err
+		}
+		gapDocs, err := scanChanges(rows)
+		if err != nil {
+			return 0, err
+		}
+		filled = append(filled, gapDocs...)
+	}
+
+	changes := coalesce(append(filled, docs...))
+	if err := w.outlet.deliver(w.tomb.Dying(), changes); err != nil {
+		return 0, err
+	}
+
+	// Only move the watermark past the changes once they're all delivered.
+	w.gaps.fill(changeIDs(filled))
+	w.gaps.observe(changeIDs(docs))
+	w.lastId = w.gaps.advance()
+
+	return len(changes), nil
+}
+
+func changeIDs(docs []change) []int64 {
+	ids := make([]int64, len(docs))
+	for i, doc := range docs {
+		ids[i] = doc.id
 	}
+	return ids
+}
+
+// scanChanges reads the changes from the rows of a change_log query, and
+// closes them.
+func scanChanges(rows *sql.Rows) ([]change, error) {
 	defer rows.Close()
 
 	var docs []change
@@ -117,21 +256,56 @@ func (w *ChangeStream) read() error {
 	}
 	for i := 0; rows.Next(); i++ {
 		if err := rows.Scan(dest(i)...); err != nil {
-			return err
+			return nil, err
 		}
 	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return docs, nil
+}
 
-	for _, chDoc := range docs {
-		select {
-		case w.changeCh <- chDoc:
-			// done
-		case <-w.tomb.Dying():
-			return tomb.ErrDying
+type changeKey struct {
+	entityType string
+	entityID   string
+}
+
+// coalesce merges every change to the same entity into a single change,
+// carrying the merged change type along with the latest ID and timestamp. The
+// changes are expected to be ordered by ID, and so is the result, by the
+// latest ID of each entity.
+func coalesce(docs []change) []change {
+	var (
+		order  []changeKey
+		merged = make(map[changeKey]change)
+	)
+	for _, doc := range docs {
+		key := changeKey{
+			entityType: doc.entityType,
+			entityID:   doc.entityID,
+		}
+		existing, ok := merged[key]
+		if !ok {
+			order = append(order, key)
+			merged[key] = doc
+			continue
 		}
+		existing.changeType = existing.changeType.Merge(doc.changeType)
+		existing.id = doc.id
+		existing.createdAt = doc.createdAt
+		merged[key] = existing
+	}
 
-		// Keep track of the last seen ID and MAX seen timestamp for the next poll.
-		w.lastId = chDoc.id
+	results := make([]change, len(order))
+	for i, key := range order {
+		results[i] = merged[key]
 	}
+	sortChanges(results)
+	return results
+}
 
-	return nil
+func sortChanges(changes []change) {
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].id < changes[j].id
+	})
 }
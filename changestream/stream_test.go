@@ -0,0 +1,72 @@
+package changestream
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/SimonRichardson/nu-juju-watchers/eventqueue"
+)
+
+func TestCoalesce(t *testing.T) {
+	const (
+		c = eventqueue.Create
+		u = eventqueue.Update
+		d = eventqueue.Delete
+	)
+	epoch := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	doc := func(id int64, changeType eventqueue.ChangeType, entityID string) change {
+		return change{
+			id:         id,
+			changeType: changeType,
+			entityType: "a",
+			entityID:   entityID,
+			createdAt:  timestamp{Time: epoch.Add(time.Duration(id) * time.Second)},
+		}
+	}
+
+	tests := []struct {
+		name     string
+		docs     []change
+		expected []change
+	}{{
+		name:     "nothing",
+		expected: []change{},
+	}, {
+		name:     "different entities",
+		docs:     []change{doc(1, c, "x"), doc(2, u, "y")},
+		expected: []change{doc(1, c, "x"), doc(2, u, "y")},
+	}, {
+		name:     "create then delete",
+		docs:     []change{doc(1, c, "x"), doc(2, d, "x")},
+		expected: []change{doc(2, c|d, "x")},
+	}, {
+		name:     "delete then create then delete",
+		docs:     []change{doc(1, d, "x"), doc(2, c, "x"), doc(3, d, "x")},
+		expected: []change{doc(3, d, "x")},
+	}, {
+		name:     "create then delete then create",
+		docs:     []change{doc(1, c, "x"), doc(2, d, "x"), doc(3, c, "x")},
+		expected: []change{doc(3, c|u, "x")},
+	}, {
+		name:     "ordered by the latest change to each entity",
+		docs:     []change{doc(1, u, "x"), doc(2, u, "y"), doc(3, u, "x")},
+		expected: []change{doc(2, u, "y"), doc(3, u, "x")},
+	}, {
+		name: "same ID for different entity types",
+		docs: []change{doc(1, u, "x"), {
+			id: 2, changeType: u, entityType: "b", entityID: "x", createdAt: doc(2, u, "x").createdAt,
+		}},
+		expected: []change{doc(1, u, "x"), {
+			id: 2, changeType: u, entityType: "b", entityID: "x", createdAt: doc(2, u, "x").createdAt,
+		}},
+	}}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if result := coalesce(test.docs); !reflect.DeepEqual(result, test.expected) {
+				t.Errorf("got %+v, expected %+v", result, test.expected)
+			}
+		})
+	}
+}
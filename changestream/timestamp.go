@@ -0,0 +1,41 @@
+package changestream
+
+import (
+	"time"
+
+	"github.com/SimonRichardson/nu-juju-watchers/db"
+	"github.com/juju/errors"
+)
+
+// timestamp scans a DATETIME column, whether the driver hands it over as a
+// time or as text. Timestamps without a zone are in UTC, as written by
+// DATETIME('now').
+type timestamp struct {
+	time.Time
+}
+
+func (t *timestamp) Scan(value interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		t.Time = time.Time{}
+		return nil
+	case time.Time:
+		t.Time = v.UTC()
+		return nil
+	case string:
+		return t.parse(v)
+	case []byte:
+		return t.parse(string(v))
+	default:
+		return errors.Errorf("unexpected timestamp type %T", value)
+	}
+}
+
+func (t *timestamp) parse(value string) error {
+	ts, err := db.ParseTimestamp(value)
+	if err != nil {
+		return err
+	}
+	t.Time = ts
+	return nil
+}
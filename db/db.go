@@ -4,6 +4,7 @@ import (
 	"database/sql"
 	"math/rand"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/canonical/go-dqlite/driver"
@@ -16,6 +17,14 @@ const (
 	DefaultDelay   = time.Millisecond * 10
 )
 
+var retries uint64
+
+// Retries returns the number of times any WithRetry call has retried, since
+// the process started.
+func Retries() uint64 {
+	return atomic.LoadUint64(&retries)
+}
+
 func WithRetry(fn func() error) error {
 	for attempt := 0; attempt < DefaultRetries; attempt++ {
 		err := fn()
@@ -32,6 +41,8 @@ func WithRetry(fn func() error) error {
 			return err
 		}
 
+		atomic.AddUint64(&retries, 1)
+
 		jitter := time.Duration(rand.Float64() + 0.5)
 		time.Sleep(DefaultDelay * jitter)
 	}
@@ -0,0 +1,33 @@
+package db
+
+import (
+	"time"
+
+	"github.com/juju/errors"
+)
+
+// timestampFormats are the formats a DATETIME column can come back in,
+// depending on the driver and on how the value was written.
+var timestampFormats = []string{
+	"2006-01-02 15:04:05.999999999-07:00",
+	"2006-01-02T15:04:05.999999999-07:00",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02T15:04",
+	"2006-01-02",
+	time.RFC3339Nano,
+}
+
+// ParseTimestamp reads a DATETIME column handed over as text. Timestamps
+// without a zone are in UTC, as written by DATETIME('now').
+func ParseTimestamp(value string) (time.Time, error) {
+	for _, format := range timestampFormats {
+		if ts, err := time.ParseInLocation(format, value, time.UTC); err == nil {
+			return ts.UTC(), nil
+		}
+	}
+	return time.Time{}, errors.NotValidf("timestamp %q", value)
+}
@@ -0,0 +1,56 @@
+package eventqueue
+
+import (
+	"testing"
+)
+
+func TestChangeTypeMerge(t *testing.T) {
+	tests := []struct {
+		changes  []ChangeType
+		expected ChangeType
+	}{
+		{changes: []ChangeType{Create}, expected: Create},
+		{changes: []ChangeType{Update, Update}, expected: Update},
+		{changes: []ChangeType{Create, Update}, expected: Create | Update},
+		{changes: []ChangeType{Update, Delete}, expected: Delete},
+		{changes: []ChangeType{Create, Delete}, expected: Create | Delete},
+		{changes: []ChangeType{Create, Update, Delete}, expected: Create | Delete},
+		{changes: []ChangeType{Delete, Create}, expected: Update},
+		{changes: []ChangeType{Delete, Create, Update}, expected: Update},
+		{changes: []ChangeType{Delete, Create, Delete}, expected: Delete},
+		{changes: []ChangeType{Create, Delete, Create}, expected: Create | Update},
+		{changes: []ChangeType{Update, Delete, Create}, expected: Update},
+		{changes: []ChangeType{Create, Delete, Create, Delete}, expected: Create | Delete},
+	}
+
+	for _, test := range tests {
+		merged := test.changes[0]
+		for _, next := range test.changes[1:] {
+			merged = merged.Merge(next)
+		}
+		if merged != test.expected {
+			t.Errorf("merging %v: got %q, expected %q", test.changes, merged, test.expected)
+		}
+	}
+}
+
+func TestChangeTypeText(t *testing.T) {
+	for _, changeType := range []ChangeType{0, Create, Update, Delete, Create | Update | Delete} {
+		text, err := changeType.MarshalText()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var result ChangeType
+		if err := result.UnmarshalText(text); err != nil {
+			t.Fatal(err)
+		}
+		if result != changeType {
+			t.Errorf("round trip of %q: got %q", text, result)
+		}
+	}
+
+	var result ChangeType
+	if err := result.UnmarshalText([]byte("cx")); err == nil {
+		t.Errorf("expected an error for an unknown change type")
+	}
+}
@@ -1,9 +1,12 @@
 package eventqueue
 
 import (
+	"context"
+	"strings"
 	"sync"
+	"time"
 
-	"github.com/juju/collections/set"
+	"github.com/juju/clock"
 	"github.com/pkg/errors"
 	"gopkg.in/tomb.v2"
 )
@@ -30,57 +33,121 @@ func (c ChangeType) String() string {
 	return result
 }
 
+// Merge folds a later change to the same entity into the change type, so that
+// a sequence of changes can be reported as one. The result always reflects
+// whether the entity exists after the later change:
+//   - a create after a delete means the entity was replaced, which is an
+//     update as far as anyone who saw it before is concerned.
+//   - a delete drops any earlier update, there is nothing left to update.
+//   - a create followed by a delete keeps both, the entity came and went.
+func (c ChangeType) Merge(next ChangeType) ChangeType {
+	switch {
+	case (next&Create) != 0 && (c&Delete) != 0:
+		return (c &^ Delete) | (next &^ Create) | Update
+	case (next & Delete) != 0:
+		return (c &^ Update) | next
+	default:
+		return c | next
+	}
+}
+
 type Change interface {
+	// ChangeID is the ID of the latest change_log entry making up the change.
+	ChangeID() int64
 	Type() ChangeType
 	EntityType() string
-	EntityID() int64
+	// EntityID is the primary key of the entity. A composite key is made of
+	// its parts by CompositeKey.
+	EntityID() string
+	// Timestamp is when the latest change_log entry making up the change was
+	// written.
+	Timestamp() time.Time
 }
 
 type Subscription interface {
 	Close() error
 	Changes() <-chan Change
+	// Batches is only delivered to if the subscription was created with the
+	// Batched option, in which case Changes is never delivered to.
+	Batches() <-chan []Change
+	// Done is closed once the subscription has ended, and its channels are
+	// closed.
+	Done() <-chan struct{}
+	// Err returns why the subscription ended. It is nil if the subscriber
+	// closed it, ErrQueueClosed if the queue was closed, the error of the
+	// context if it was cancelled, and otherwise the error that ended it.
+	Err() error
 }
 
-type ChangeStream interface {
-	Changes() <-chan Change
-}
+// ErrQueueClosed is the error of the subscriptions ended by the queue closing.
+var ErrQueueClosed = errors.New("event queue closed")
 
-type subscription struct {
-	id       int
-	changeCh chan Change
-	topics   set.Strings
+// ErrReplayUnsupported is returned by Subscribe for a subscription with
+// SinceChangeID, if the change stream of the queue isn't a Replayer.
+var ErrReplayUnsupported = errors.New("change stream can not replay changes")
 
-	unsubFn func() error
+type ChangeStream interface {
+	Changes() <-chan Change
 }
 
-func (s *subscription) Close() error {
-	return s.unsubFn()
+// BatchChangeStream is a ChangeStream that can deliver all the changes it
+// reads in one go.
+type BatchChangeStream interface {
+	ChangeStream
+	Batches() <-chan []Change
 }
 
-func (s *subscription) Changes() <-chan Change {
-	return s.changeCh
+// Replayer is implemented by change streams that can replay the changes made
+// after a change ID.
+type Replayer interface {
+	Replay(since int64) ([]Change, error)
 }
 
 type eventFilter struct {
 	subscriptionID int
 	changeMask     ChangeType
 	filterFn       func(Change) bool
+	filter         *Filter
 }
 
 type EventQueue struct {
 	tomb         tomb.Tomb
 	changeStream ChangeStream
+	clock        clock.Clock
+	workers      int
 
 	mu            sync.Mutex
+	closed        bool
+	nextSubID     int
 	subscriptions map[int]*subscription
 	subsByTopic   map[string][]eventFilter
+	subsByPrefix  map[string][]eventFilter
+
+	// replays hands the replays read for the subscriptions to the loop.
+	replays chan replayResult
+}
+
+// replayResult is the outcome of replaying the changes for a subscription.
+type replayResult struct {
+	sub     *subscription
+	changes []Change
+	err     error
 }
 
-func New(changeStream ChangeStream) *EventQueue {
+func New(changeStream ChangeStream, opts ...Option) *EventQueue {
+	o := newOptions()
+	for _, opt := range opts {
+		opt(o)
+	}
+
 	eventQueue := &EventQueue{
 		changeStream:  changeStream,
+		clock:         o.clock,
+		workers:       o.dispatchWorkers,
 		subscriptions: make(map[int]*subscription),
 		subsByTopic:   make(map[string][]eventFilter),
+		subsByPrefix:  make(map[string][]eventFilter),
+		replays:       make(chan replayResult),
 	}
 
 	eventQueue.tomb.Go(eventQueue.loop)
@@ -88,38 +155,88 @@ func New(changeStream ChangeStream) *EventQueue {
 	return eventQueue
 }
 
-func (s *EventQueue) Subscribe(opts ...SubscriptionOption) (Subscription, error) {
-	if len(opts) == 0 {
-		return nil, errors.Errorf("no subscription options specified")
+// Subscribe creates a subscription to the changes matching the topics of the
+// options. The subscription ends when the context is cancelled.
+func (s *EventQueue) Subscribe(ctx context.Context, opts ...SubscriptionOption) (Subscription, error) {
+	var (
+		config subscriptionConfig
+		topics []SubscriptionOption
+	)
+	for _, opt := range opts {
+		if opt.configFn != nil {
+			opt.configFn(&config)
+			continue
+		}
+		if opt.filter != nil {
+			if err := opt.filter.Validate(); err != nil {
+				return nil, errors.Wrapf(err, "topic %q", opt.entityType)
+			}
+		}
+		topics = append(topics, opt)
+	}
+	if len(topics) == 0 {
+		return nil, errors.Errorf("no subscription topics specified")
+	}
+	replayer, ok := s.changeStream.(Replayer)
+	if config.replay && !ok {
+		return nil, ErrReplayUnsupported
 	}
 
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	// Create a new subscription and assign a unique ID to it.
-	subID := len(s.subscriptions)
-	sub := &subscription{
-		id:       subID,
-		changeCh: make(chan Change),
-		topics:   set.NewStrings(),
-		unsubFn:  func() error { return s.unsubscribe(subID) },
+	// Nobody would ever close a subscription to a queue that has gone.
+	if s.closed {
+		return nil, ErrQueueClosed
 	}
+
+	// Create a new subscription and assign a unique ID to it. IDs are never
+	// reused, so a late Close of a subscription can't close another one.
+	subID := s.nextSubID
+	s.nextSubID++
+	sub := newSubscription(subID, config, s.clock, func() error { return s.unsubscribe(subID, nil) })
 	s.subscriptions[sub.id] = sub
 
 	// Register filters to route changes matching the subscription criteria to the newly crated subscription.
-	for _, opt := range opts {
-		s.subsByTopic[opt.entityType] = append(s.subsByTopic[opt.entityType], eventFilter{
+	for _, opt := range topics {
+		filters := s.topicFilters(opt.entityType)
+		key := topicKey(opt.entityType)
+		filters[key] = append(filters[key], eventFilter{
 			subscriptionID: sub.id,
 			changeMask:     opt.changeMask,
 			filterFn:       opt.filterFn,
+			filter:         opt.filter,
 		})
 		sub.topics.Add(opt.entityType)
 	}
 
+	// The replay is read off the loop, so it doesn't hold up the delivery of
+	// changes to everyone else.
+	if config.replay {
+		s.tomb.Go(func() error {
+			changes, err := replayer.Replay(config.since)
+			select {
+			case s.replays <- replayResult{sub: sub, changes: changes, err: err}:
+			case <-s.tomb.Dying():
+			}
+			return nil
+		})
+	}
+
+	if done := ctx.Done(); done != nil {
+		go func() {
+			select {
+			case <-done:
+				_ = s.unsubscribe(subID, ctx.Err())
+			case <-sub.done:
+			}
+		}()
+	}
+
 	return sub, nil
 }
 
-func (s *EventQueue) unsubscribe(subscriptionID int) error {
+func (s *EventQueue) unsubscribe(subscriptionID int, err error) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
@@ -129,64 +246,268 @@ func (s *EventQueue) unsubscribe(subscriptionID int) error {
 	}
 
 	for topic := range sub.topics {
+		filters := s.topicFilters(topic)
+		key := topicKey(topic)
+
 		var updatedFilters []eventFilter
-		for _, filter := range s.subsByTopic[topic] {
+		for _, filter := range filters[key] {
 			if filter.subscriptionID == subscriptionID {
 				continue
 			}
 			updatedFilters = append(updatedFilters, filter)
 		}
-		s.subsByTopic[topic] = updatedFilters
+		if len(updatedFilters) == 0 {
+			delete(filters, key)
+			continue
+		}
+		filters[key] = updatedFilters
 	}
 
 	delete(s.subscriptions, subscriptionID)
-	close(sub.changeCh)
+	sub.stop(err)
 	return nil
 }
 
 func (s *EventQueue) loop() error {
-	defer func() {
-		for _, sub := range s.subscriptions {
-			close(sub.changeCh)
-		}
-		s.subscriptions = make(map[int]*subscription)
-	}()
+	err := s.run()
+
+	// The stream can end the loop before the queue is closed, so the tomb is
+	// killed here for the replays still being read to give up.
+	s.tomb.Kill(err)
+
+	// Let the subscribers know why they're being closed.
+	subErr := err
+	if err == nil || err == tomb.ErrDying {
+		subErr = ErrQueueClosed
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	for _, sub := range s.subscriptions {
+		sub.stop(subErr)
+	}
+	s.subscriptions = make(map[int]*subscription)
+	s.subsByTopic = make(map[string][]eventFilter)
+	s.subsByPrefix = make(map[string][]eventFilter)
+
+	return err
+}
+
+func (s *EventQueue) run() error {
+	// Streams that can deliver batches are read a batch at a time, so every
+	// subscription sees all the changes from a single read together.
+	var batches <-chan []Change
+	if batchStream, ok := s.changeStream.(BatchChangeStream); ok {
+		batches = batchStream.Batches()
+	}
 
 	for {
-		var (
-			ch Change
-			ok bool
-		)
+		var changes []Change
 		select {
 		case <-s.tomb.Dying():
 			return tomb.ErrDying
-		case ch, ok = <-s.changeStream.Changes():
+		case result := <-s.replays:
+			if err := s.replay(result); err != nil {
+				return err
+			}
+			continue
+		case ch, ok := <-s.changeStream.Changes():
+			if !ok {
+				return nil // EOF
+			}
+			changes = []Change{ch}
+		case batch, ok := <-batches:
 			if !ok {
 				return nil // EOF
 			}
-			// Read next change
+			changes = batch
 		}
 
-		s.mu.Lock()
-		for _, subOpt := range s.subsByTopic[ch.EntityType()] {
-			if (ch.Type() & subOpt.changeMask) == 0 {
-				continue
+		if err := s.dispatch(changes); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *EventQueue) dispatch(changes []Change) error {
+	subs, bySub := s.match(changes, func(*subscription) bool {
+		return true
+	})
+
+	// The lock isn't held while the changes are queued, so that a blocked
+	// subscription doesn't hold up subscribing or unsubscribing.
+	deliver := func(sub *subscription) error {
+		// A subscription waiting for its replay holds on to the changes, to
+		// be delivered after it.
+		if sub.replaying {
+			sub.held = append(sub.held, bySub[sub.id]...)
+			return nil
+		}
+		subChanges := sub.skipReplayed(bySub[sub.id])
+		if len(subChanges) == 0 {
+			return nil
+		}
+		return s.enqueue(sub, subChanges)
+	}
+
+	if s.workers <= 1 || len(subs) <= 1 {
+		for _, sub := range subs {
+			if err := deliver(sub); err != nil {
+				return err
 			}
+		}
+		return nil
+	}
 
-			if subOpt.filterFn != nil && !subOpt.filterFn(ch) {
-				continue
+	// Each subscription always goes to the same worker, and every worker is
+	// done before the next changes are dispatched, so each subscription still
+	// sees the changes in order.
+	partitions := make([][]*subscription, s.workers)
+	for _, sub := range subs {
+		i := sub.id % s.workers
+		partitions[i] = append(partitions[i], sub)
+	}
+
+	var (
+		wg   sync.WaitGroup
+		errs = make([]error, s.workers)
+	)
+	for i, partition := range partitions {
+		if len(partition) == 0 {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, partition []*subscription) {
+			defer wg.Done()
+			for _, sub := range partition {
+				if err := deliver(sub); err != nil {
+					errs[i] = err
+					return
+				}
 			}
+		}(i, partition)
+	}
+	wg.Wait()
 
-			select {
-			case <-s.tomb.Dying():
-				s.mu.Unlock()
-				return tomb.ErrDying
-			case s.subscriptions[subOpt.subscriptionID].changeCh <- ch:
-				// pushed change.
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// replay delivers the replayed changes to the subscription waiting for them,
+// followed by the changes held for it in the meantime. It is only called from
+// the loop, between dispatches, so the replay always lands before any live
+// change.
+func (s *EventQueue) replay(result replayResult) error {
+	sub := result.sub
+
+	s.mu.Lock()
+	_, subscribed := s.subscriptions[sub.id]
+	s.mu.Unlock()
+	if !subscribed {
+		return nil
+	}
+	if result.err != nil {
+		_ = s.unsubscribe(sub.id, result.err)
+		return nil
+	}
+
+	sub.setReplayed(result.changes)
+	held := sub.skipReplayed(sub.held)
+	sub.held = nil
+	sub.replaying = false
+
+	_, bySub := s.match(result.changes, func(candidate *subscription) bool {
+		return candidate == sub
+	})
+	changes := append(bySub[sub.id], held...)
+	if len(changes) == 0 {
+		return nil
+	}
+	return s.enqueue(sub, changes)
+}
+
+// enqueue queues the changes for the subscription, killing it if it can't
+// keep up. Only a dying queue is reported.
+func (s *EventQueue) enqueue(sub *subscription, changes []Change) error {
+	err := sub.enqueue(s.tomb.Dying(), changes)
+	if err == ErrSlowConsumer {
+		_ = s.unsubscribe(sub.id, err)
+		return nil
+	}
+	return err
+}
+
+// match gathers the changes for each included subscription, in the order they
+// happened. A change that matches more than one topic of a subscription is
+// only matched to it once.
+func (s *EventQueue) match(changes []Change, include func(*subscription) bool) ([]*subscription, map[int][]Change) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var (
+		subs    []*subscription
+		bySub   = make(map[int][]Change)
+		lastIdx = make(map[int]int)
+	)
+	for i, ch := range changes {
+		matchFilters := func(filters []eventFilter) {
+			for _, subOpt := range filters {
+				if (ch.Type() & subOpt.changeMask) == 0 {
+					continue
+				}
+
+				if subOpt.filterFn != nil && !subOpt.filterFn(ch) {
+					continue
+				}
+
+				subChanges, ok := bySub[subOpt.subscriptionID]
+				if !ok {
+					sub := s.subscriptions[subOpt.subscriptionID]
+					if !include(sub) {
+						continue
+					}
+					subs = append(subs, sub)
+				} else if lastIdx[subOpt.subscriptionID] == i {
+					continue
+				}
+				lastIdx[subOpt.subscriptionID] = i
+				bySub[subOpt.subscriptionID] = append(subChanges, ch)
+			}
+		}
+
+		matchFilters(s.subsByTopic[ch.EntityType()])
+		for prefix, filters := range s.subsByPrefix {
+			if strings.HasPrefix(ch.EntityType(), prefix) {
+				matchFilters(filters)
 			}
 		}
-		s.mu.Unlock()
 	}
+	return subs, bySub
+}
+
+// topicFilters returns the filters for the topic, depending on whether it is
+// an exact entity type or a wildcard.
+func (s *EventQueue) topicFilters(topic string) map[string][]eventFilter {
+	if isWildcard(topic) {
+		return s.subsByPrefix
+	}
+	return s.subsByTopic
+}
+
+func isWildcard(topic string) bool {
+	return strings.HasSuffix(topic, AllEntities)
+}
+
+// topicKey returns the key of the topic in its filters; the prefix of a
+// wildcard, or the entity type itself.
+func topicKey(topic string) string {
+	return strings.TrimSuffix(topic, AllEntities)
 }
 
 func (w *EventQueue) Wait() <-chan struct{} {
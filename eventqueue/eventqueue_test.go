@@ -0,0 +1,362 @@
+package eventqueue
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/juju/clock/testclock"
+)
+
+type testChange struct {
+	id         int64
+	changeType ChangeType
+	entityType string
+	entityID   int64
+}
+
+func (c testChange) ChangeID() int64      { return c.id }
+func (c testChange) Type() ChangeType     { return c.changeType }
+func (c testChange) EntityType() string   { return c.entityType }
+func (c testChange) EntityID() string     { return strconv.FormatInt(c.entityID, 10) }
+func (c testChange) Timestamp() time.Time { return time.Time{} }
+
+type testStream struct {
+	changes chan Change
+}
+
+func newTestStream() *testStream {
+	return &testStream{changes: make(chan Change)}
+}
+
+func (s *testStream) Changes() <-chan Change {
+	return s.changes
+}
+
+// produce sends changes to a handful of entities of the entity types until it
+// is stopped, or the queue stops reading.
+func (s *testStream) produce(stop <-chan struct{}, entityTypes ...string) {
+	changeTypes := []ChangeType{Create, Update, Delete}
+	for id := int64(1); ; id++ {
+		ch := testChange{
+			id:         id,
+			changeType: changeTypes[id%3],
+			entityType: entityTypes[id%int64(len(entityTypes))],
+			entityID:   id % 13,
+		}
+		select {
+		case s.changes <- ch:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// replayStream is a testStream whose replays are held until they are
+// released.
+type replayStream struct {
+	*testStream
+	release chan struct{}
+}
+
+func (s replayStream) Replay(since int64) ([]Change, error) {
+	<-s.release
+	return nil, nil
+}
+
+func TestStreamEndsDuringReplay(t *testing.T) {
+	stream := replayStream{testStream: newTestStream(), release: make(chan struct{})}
+	queue := New(stream)
+
+	if _, err := queue.Subscribe(context.Background(), Topic("a", Create), SinceChangeID(1)); err != nil {
+		t.Fatal(err)
+	}
+
+	// The stream ends while the replay is still being read, and the queue
+	// is never closed.
+	close(stream.changes)
+	time.Sleep(10 * time.Millisecond)
+	close(stream.release)
+
+	select {
+	case <-queue.Wait():
+	case <-time.After(5 * time.Second):
+		t.Fatal("queue not done once its stream ended")
+	}
+}
+
+func TestDebounceDoesNotFillBuffer(t *testing.T) {
+	clock := testclock.NewClock(time.Now())
+	stream := newTestStream()
+	queue := New(stream, WithClock(clock))
+	defer queue.Close()
+
+	sub, err := queue.Subscribe(context.Background(),
+		Topic("a", Update), Debounce(time.Second), BufferSize(2), OnOverflow(Block))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Many more changes than the buffer holds are made within the window,
+	// but only to as many entities as it holds.
+	sent := make(chan struct{})
+	go func() {
+		defer close(sent)
+		for id := int64(1); id <= 100; id++ {
+			stream.changes <- testChange{id: id, changeType: Update, entityType: "a", entityID: id % 2}
+		}
+		// The queue only reads this once it has dispatched the last of them.
+		stream.changes <- testChange{id: 101, changeType: Update, entityType: "b"}
+	}()
+	select {
+	case <-sent:
+	case <-time.After(5 * time.Second):
+		t.Fatal("dispatch blocked by a debounced subscription")
+	}
+
+	if err := clock.WaitAdvance(time.Second, 5*time.Second, 1); err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []int64{99, 100} {
+		if ch := <-sub.Changes(); ch.ChangeID() != expected {
+			t.Errorf("got change %d, expected %d", ch.ChangeID(), expected)
+		}
+	}
+}
+
+var stressPolicies = []OverflowPolicy{Block, DropOldest, Coalesce, Kill}
+
+func TestStressSubscribeUnsubscribe(t *testing.T) {
+	testStressSubscribeUnsubscribe(t)
+}
+
+func TestStressSubscribeUnsubscribeParallelDispatch(t *testing.T) {
+	testStressSubscribeUnsubscribe(t, WithParallelDispatch(4))
+}
+
+// testStressSubscribeUnsubscribe subscribes and unsubscribes, with every
+// overflow policy, while the queue is flooded with changes, and closes the
+// queue while the changes are still being dispatched.
+func testStressSubscribeUnsubscribe(t *testing.T, opts ...Option) {
+	stream := newTestStream()
+	queue := New(stream, opts...)
+
+	stop := make(chan struct{})
+	produced := make(chan struct{})
+	go func() {
+		defer close(produced)
+		stream.produce(stop, "a", "b", "application_c")
+	}()
+
+	const workers = 32
+	var (
+		wg     sync.WaitGroup
+		errsMu sync.Mutex
+		errs   []string
+	)
+	fail := func(format string, args ...interface{}) {
+		errsMu.Lock()
+		defer errsMu.Unlock()
+		errs = append(errs, fmt.Sprintf(format, args...))
+	}
+
+	deadline := time.Now().Add(500 * time.Millisecond)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(int64(w)))
+
+			for time.Now().Before(deadline) {
+				if !stressSubscription(queue, rnd, fail) {
+					return
+				}
+			}
+		}(w)
+	}
+
+	// Close the queue from under the subscribers, while changes are still
+	// flowing.
+	time.Sleep(300 * time.Millisecond)
+	if err := queue.Close(); err != nil {
+		t.Fatalf("closing queue: %v", err)
+	}
+	wg.Wait()
+	close(stop)
+	<-produced
+
+	if _, err := queue.Subscribe(context.Background(), Topic("a", Create)); err != ErrQueueClosed {
+		t.Errorf("subscribing to closed queue: expected %v, got %v", ErrQueueClosed, err)
+	}
+	for _, err := range errs {
+		t.Error(err)
+	}
+}
+
+// stressSubscription subscribes with a random configuration, reads some of the
+// changes, and ends the subscription in one of the ways it can end. It returns
+// false once the queue is closed.
+func stressSubscription(queue *EventQueue, rnd *rand.Rand, fail func(string, ...interface{})) bool {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	policy := stressPolicies[rnd.Intn(len(stressPolicies))]
+	opts := []SubscriptionOption{
+		Topic("a", Create|Update|Delete),
+		Topic("application_*", Update),
+		BufferSize(1 + rnd.Intn(16)),
+		OnOverflow(policy),
+	}
+	batched := rnd.Intn(2) == 0
+	if batched {
+		opts = append(opts, Batched())
+	}
+
+	sub, err := queue.Subscribe(ctx, opts...)
+	if err == ErrQueueClosed {
+		return false
+	} else if err != nil {
+		fail("subscribing: %v", err)
+		return false
+	}
+
+	// Every policy keeps the changes in order, even when it drops or merges
+	// some of them.
+	var last int64
+	check := func(ch Change) {
+		if ch.ChangeID() <= last {
+			fail("policy %d: change %d after change %d", policy, ch.ChangeID(), last)
+		}
+		last = ch.ChangeID()
+	}
+	read := func(n int) bool {
+		for i := 0; i < n; i++ {
+			if batched {
+				batch, ok := <-sub.Batches()
+				if !ok {
+					return false
+				}
+				for _, ch := range batch {
+					check(ch)
+				}
+				continue
+			}
+			ch, ok := <-sub.Changes()
+			if !ok {
+				return false
+			}
+			check(ch)
+		}
+		return true
+	}
+
+	if !read(rnd.Intn(50)) {
+		return endedByQueue(sub, policy, fail)
+	}
+
+	// A blocking subscription must be ended straight away, the others can be
+	// left behind for a while before they are ended.
+	if policy != Block && rnd.Intn(4) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	switch rnd.Intn(2) {
+	case 0:
+		if err := sub.Close(); err != nil {
+			fail("closing subscription: %v", err)
+		}
+		select {
+		case <-sub.Done():
+		default:
+			fail("subscription not done once closed")
+		}
+		if err := sub.Err(); err != nil && err != ErrQueueClosed && err != ErrSlowConsumer {
+			fail("closed subscription: unexpected error %v", err)
+		}
+
+	case 1:
+		cancel()
+		select {
+		case <-sub.Done():
+		case <-time.After(5 * time.Second):
+			fail("subscription not done once its context was cancelled")
+			return false
+		}
+		if err := sub.Err(); err != context.Canceled && err != ErrQueueClosed && err != ErrSlowConsumer {
+			fail("cancelled subscription: unexpected error %v", err)
+		}
+	}
+	return true
+}
+
+// endedByQueue checks a subscription ended while it was being read was ended
+// for a reason the queue can have.
+func endedByQueue(sub Subscription, policy OverflowPolicy, fail func(string, ...interface{})) bool {
+	select {
+	case <-sub.Done():
+	case <-time.After(5 * time.Second):
+		fail("subscription channels closed before it was done")
+		return false
+	}
+
+	switch err := sub.Err(); err {
+	case ErrQueueClosed:
+		return false
+	case ErrSlowConsumer:
+		if policy != Kill {
+			fail("policy %d: subscription killed", policy)
+		}
+		return true
+	default:
+		fail("policy %d: unexpected error %v", policy, err)
+		return false
+	}
+}
+
+func BenchmarkDispatchSerial(b *testing.B) {
+	benchmarkDispatch(b)
+}
+
+func BenchmarkDispatchParallel(b *testing.B) {
+	benchmarkDispatch(b, WithParallelDispatch(8))
+}
+
+// benchmarkDispatch measures dispatching a change to every subscription, for
+// a growing number of subscriptions that read as fast as they can.
+func benchmarkDispatch(b *testing.B, opts ...Option) {
+	for _, n := range []int{1, 100, 10000} {
+		b.Run(fmt.Sprintf("subscriptions=%d", n), func(b *testing.B) {
+			queue := New(newTestStream(), opts...)
+			defer queue.Close()
+
+			for i := 0; i < n; i++ {
+				sub, err := queue.Subscribe(context.Background(), Topic("a", Create|Update|Delete))
+				if err != nil {
+					b.Fatal(err)
+				}
+				go func() {
+					for range sub.Changes() {
+					}
+				}()
+			}
+
+			changes := make([]Change, 1)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				changes[0] = testChange{
+					id:         int64(i + 1),
+					changeType: Update,
+					entityType: "a",
+					entityID:   int64(i % 13),
+				}
+				if err := queue.dispatch(changes); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,105 @@
+package eventqueue
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Filter is a declarative alternative to the function given to FilteredTopic.
+// Unlike a function, it can be inspected and sent over the wire. A change
+// matches the filter if it matches every criterion that is set; the zero
+// Filter matches everything.
+type Filter struct {
+	// EntityIDs matches changes to any of the given entities.
+	EntityIDs []string `json:"entity-ids,omitempty"`
+	// EntityIDPrefix matches changes to the entities with IDs starting with
+	// the prefix, such as every entity of a model with a composite key.
+	EntityIDPrefix string `json:"entity-id-prefix,omitempty"`
+	// EntityIDRange matches changes to the entities with integer IDs within
+	// the range. Entities without an integer ID never match it.
+	EntityIDRange *IDRange `json:"entity-id-range,omitempty"`
+	// ChangeTypes matches changes of any of the given types.
+	ChangeTypes ChangeType `json:"change-types,omitempty"`
+}
+
+// IDRange is an inclusive range of entity IDs. A zero To leaves the range
+// open ended.
+type IDRange struct {
+	From int64 `json:"from"`
+	To   int64 `json:"to,omitempty"`
+}
+
+// Validate checks the filter can match anything at all.
+func (f Filter) Validate() error {
+	if r := f.EntityIDRange; r != nil && r.To != 0 && r.To < r.From {
+		return errors.Errorf("entity ID range %d to %d is empty", r.From, r.To)
+	}
+	if f.ChangeTypes&^(Create|Update|Delete) != 0 {
+		return errors.Errorf("unknown change types %d", f.ChangeTypes)
+	}
+	return nil
+}
+
+// Compile turns the filter into a function, for the same matching path as
+// FilteredTopic.
+func (f Filter) Compile() func(Change) bool {
+	var ids map[string]struct{}
+	if len(f.EntityIDs) > 0 {
+		ids = make(map[string]struct{}, len(f.EntityIDs))
+		for _, id := range f.EntityIDs {
+			ids[id] = struct{}{}
+		}
+	}
+	prefix := f.EntityIDPrefix
+	idRange := f.EntityIDRange
+	changeTypes := f.ChangeTypes
+
+	return func(ch Change) bool {
+		if ids != nil {
+			if _, ok := ids[ch.EntityID()]; !ok {
+				return false
+			}
+		}
+		if prefix != "" && !strings.HasPrefix(ch.EntityID(), prefix) {
+			return false
+		}
+		if idRange != nil {
+			id, err := strconv.ParseInt(ch.EntityID(), 10, 64)
+			if err != nil {
+				return false
+			}
+			if id < idRange.From || (idRange.To != 0 && id > idRange.To) {
+				return false
+			}
+		}
+		if changeTypes != 0 && (ch.Type()&changeTypes) == 0 {
+			return false
+		}
+		return true
+	}
+}
+
+// MarshalText encodes the change type as its string form, such as "cu".
+func (c ChangeType) MarshalText() ([]byte, error) {
+	return []byte(c.String()), nil
+}
+
+func (c *ChangeType) UnmarshalText(text []byte) error {
+	var result ChangeType
+	for _, r := range strings.ToLower(string(text)) {
+		switch r {
+		case 'c':
+			result |= Create
+		case 'u':
+			result |= Update
+		case 'd':
+			result |= Delete
+		default:
+			return errors.Errorf("unknown change type %q", r)
+		}
+	}
+	*c = result
+	return nil
+}
@@ -0,0 +1,81 @@
+package eventqueue
+
+import (
+	"sort"
+	"time"
+)
+
+// SubscriptionInfo describes a subscription to the queue, for diagnosing
+// watchers that are stuck or falling behind.
+type SubscriptionInfo struct {
+	ID     int         `json:"id"`
+	Topics []TopicInfo `json:"topics"`
+	// QueueDepth is the number of changes waiting for the subscriber to read
+	// them.
+	QueueDepth   int       `json:"queue-depth"`
+	Delivered    uint64    `json:"delivered"`
+	LastDelivery time.Time `json:"last-delivery"`
+}
+
+type TopicInfo struct {
+	EntityType string     `json:"entity-type"`
+	ChangeMask ChangeType `json:"change-mask"`
+	// Filtered is true if the topic is filtered, in which case Filter is the
+	// filter if it is a declarative one.
+	Filtered bool    `json:"filtered,omitempty"`
+	Filter   *Filter `json:"filter,omitempty"`
+}
+
+// Subscriptions returns the current subscriptions to the queue, ordered by ID.
+func (s *EventQueue) Subscriptions() []SubscriptionInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	infos := make(map[int]*SubscriptionInfo, len(s.subscriptions))
+	for id, sub := range s.subscriptions {
+		infos[id] = sub.info()
+	}
+
+	addTopics := func(filters map[string][]eventFilter, suffix string) {
+		for key, keyFilters := range filters {
+			for _, filter := range keyFilters {
+				info, ok := infos[filter.subscriptionID]
+				if !ok {
+					continue
+				}
+				info.Topics = append(info.Topics, TopicInfo{
+					EntityType: key + suffix,
+					ChangeMask: filter.changeMask,
+					Filtered:   filter.filterFn != nil,
+					Filter:     filter.filter,
+				})
+			}
+		}
+	}
+	addTopics(s.subsByTopic, "")
+	addTopics(s.subsByPrefix, AllEntities)
+
+	results := make([]SubscriptionInfo, 0, len(infos))
+	for _, info := range infos {
+		sort.Slice(info.Topics, func(i, j int) bool {
+			return info.Topics[i].EntityType < info.Topics[j].EntityType
+		})
+		results = append(results, *info)
+	}
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].ID < results[j].ID
+	})
+	return results
+}
+
+func (s *subscription) info() *SubscriptionInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return &SubscriptionInfo{
+		ID:           s.id,
+		QueueDepth:   len(s.buffer) + s.inflight,
+		Delivered:    s.delivered,
+		LastDelivery: s.lastDelivery,
+	}
+}
@@ -0,0 +1,20 @@
+package eventqueue
+
+import "strings"
+
+// KeySeparator separates the parts of a composite key. It is the ASCII unit
+// separator, which is char(31) in SQL, so a trigger can build the same key
+// with:
+//
+//	NEW.model_uuid || char(31) || NEW.key
+const KeySeparator = "\x1f"
+
+// CompositeKey joins the parts of a composite primary key into an entity ID.
+func CompositeKey(parts ...string) string {
+	return strings.Join(parts, KeySeparator)
+}
+
+// SplitKey splits an entity ID back into the parts of its composite key.
+func SplitKey(entityID string) []string {
+	return strings.Split(entityID, KeySeparator)
+}
@@ -1,11 +1,69 @@
 package eventqueue
 
+import (
+	"time"
+
+	"github.com/juju/clock"
+)
+
+type Option func(*options)
+
+type options struct {
+	clock           clock.Clock
+	dispatchWorkers int
+}
+
+func newOptions() *options {
+	return &options{
+		clock: clock.WallClock,
+	}
+}
+
+// WithClock sets the clock used to time debounced subscriptions.
+func WithClock(clock clock.Clock) Option {
+	return func(o *options) {
+		o.clock = clock
+	}
+}
+
+// WithParallelDispatch queues the changes for the subscriptions on a number
+// of workers at once, rather than one subscription after another. A blocked
+// subscription then only holds up the other subscriptions on its worker,
+// although the next changes still wait for it. Every subscription still gets
+// its changes in order.
+func WithParallelDispatch(workers int) Option {
+	return func(o *options) {
+		o.dispatchWorkers = workers
+	}
+}
+
 type SubscriptionOption struct {
 	entityType string
 	changeMask ChangeType
 	filterFn   func(Change) bool
+	filter     *Filter
+
+	// configFn is set for options that configure the subscription, rather
+	// than add a topic to it.
+	configFn func(*subscriptionConfig)
+}
+
+type subscriptionConfig struct {
+	batched    bool
+	bufferSize int
+	policy     OverflowPolicy
+	replay     bool
+	since      int64
+	debounce   time.Duration
 }
 
+// AllEntities is the wildcard of a topic. On its own it matches every entity
+// type; at the end of a topic, such as "application_*", it matches every
+// entity type starting with what comes before it.
+const AllEntities = "*"
+
+// Topic matches the changes to the entity type, or to every matching entity
+// type if it ends with the AllEntities wildcard.
 func Topic(entityType string, changeMask ChangeType) SubscriptionOption {
 	return SubscriptionOption{
 		entityType: entityType,
@@ -13,8 +71,80 @@ func Topic(entityType string, changeMask ChangeType) SubscriptionOption {
 	}
 }
 
+// AnyTopic matches the changes to every entity type.
+func AnyTopic(changeMask ChangeType) SubscriptionOption {
+	return Topic(AllEntities, changeMask)
+}
+
 func FilteredTopic(entityType string, changeMask ChangeType, filterFn func(Change) bool) SubscriptionOption {
 	opt := Topic(entityType, changeMask)
 	opt.filterFn = filterFn
 	return opt
 }
+
+// FilterTopic is FilteredTopic with a declarative filter, which is kept on the
+// subscription so it can be inspected.
+func FilterTopic(entityType string, changeMask ChangeType, filter Filter) SubscriptionOption {
+	opt := FilteredTopic(entityType, changeMask, filter.Compile())
+	opt.filter = &filter
+	return opt
+}
+
+// Batched delivers the changes on the Batches channel of the subscription,
+// all the matching changes buffered since the subscriber last read at a time.
+// A batch may span several reads of the change stream, so the changes to each
+// entity are merged into a single change, as with Debounce.
+func Batched() SubscriptionOption {
+	return SubscriptionOption{
+		configFn: func(c *subscriptionConfig) {
+			c.batched = true
+		},
+	}
+}
+
+// BufferSize sets the number of changes buffered for the subscriber, before
+// the overflow policy kicks in. It defaults to DefaultBufferSize.
+func BufferSize(size int) SubscriptionOption {
+	return SubscriptionOption{
+		configFn: func(c *subscriptionConfig) {
+			c.bufferSize = size
+		},
+	}
+}
+
+// OnOverflow sets what happens when the buffer of the subscription is full.
+// It defaults to Block.
+func OnOverflow(policy OverflowPolicy) SubscriptionOption {
+	return SubscriptionOption{
+		configFn: func(c *subscriptionConfig) {
+			c.policy = policy
+		},
+	}
+}
+
+// Debounce gathers the changes made within the window after the first one,
+// and delivers them together, merged into a single change per entity. The
+// changes are merged as they are buffered, so the buffer size bounds the
+// number of entities changed within the window, rather than the number of
+// changes. The window is timed by the clock of the queue.
+func Debounce(window time.Duration) SubscriptionOption {
+	return SubscriptionOption{
+		configFn: func(c *subscriptionConfig) {
+			c.debounce = window
+		},
+	}
+}
+
+// SinceChangeID replays the matching changes made after the change ID, before
+// delivering the changes made from then on. Nothing is missed or delivered
+// twice in between, so a watcher can read its initial state at a change ID
+// and carry on from there. The change stream of the queue must implement
+// Replayer.
+func SinceChangeID(id int64) SubscriptionOption {
+	return SubscriptionOption{
+		configFn: func(c *subscriptionConfig) {
+			c.replay = true
+			c.since = id
+		},
+	}
+}
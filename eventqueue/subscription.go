@@ -0,0 +1,429 @@
+package eventqueue
+
+import (
+	"sync"
+	"time"
+
+	"github.com/juju/clock"
+	"github.com/juju/collections/set"
+	"github.com/pkg/errors"
+	"gopkg.in/tomb.v2"
+)
+
+// OverflowPolicy decides what happens to a change when the buffer of the
+// subscription it is for is full.
+type OverflowPolicy int
+
+const (
+	// Block waits for the subscriber to make room in its buffer. This holds
+	// up the delivery of the change to every other subscription.
+	Block OverflowPolicy = iota
+	// DropOldest makes room by dropping the oldest change in the buffer.
+	DropOldest
+	// Coalesce merges the change with a buffered change to the same entity.
+	// If there isn't one, it waits for room as Block does.
+	Coalesce
+	// Kill closes the subscription, with ErrSlowConsumer as its error.
+	Kill
+)
+
+const (
+	DefaultBufferSize = 1024
+)
+
+// ErrSlowConsumer is the error of a subscription closed by the Kill overflow
+// policy.
+var ErrSlowConsumer = errors.New("subscription buffer overflowed")
+
+type subscription struct {
+	id       int
+	changeCh chan Change
+	batchCh  chan []Change
+	batched  bool
+	topics   set.Strings
+
+	bufferSize int
+	policy     OverflowPolicy
+	debounce   time.Duration
+	clock      clock.Clock
+
+	mu     sync.Mutex
+	buffer []Change
+	err    error
+
+	// inflight is the number of changes taken out of the buffer by the pump,
+	// but not yet read by the subscriber.
+	inflight     int
+	delivered    uint64
+	lastDelivery time.Time
+
+	// notify wakes the pump when there are changes in the buffer, and space
+	// wakes a blocked dispatch when there is room in it.
+	notify chan struct{}
+	space  chan struct{}
+
+	stopOnce sync.Once
+	done     chan struct{}
+	// pumped is closed once the pump has closed the channels.
+	pumped chan struct{}
+
+	unsubFn func() error
+
+	// The replay state is only used by the loop of the queue, and the
+	// dispatch workers it waits for. The changes dispatched while the replay
+	// is being read are held until it is delivered.
+	replaying   bool
+	replaySince int64
+	replayHead  int64
+	replayed    map[int64]struct{}
+	held        []Change
+}
+
+func newSubscription(id int, config subscriptionConfig, clock clock.Clock, unsubFn func() error) *subscription {
+	bufferSize := config.bufferSize
+	if bufferSize <= 0 {
+		bufferSize = DefaultBufferSize
+	}
+
+	sub := &subscription{
+		id:         id,
+		changeCh:   make(chan Change),
+		batchCh:    make(chan []Change),
+		batched:    config.batched,
+		topics:     set.NewStrings(),
+		bufferSize: bufferSize,
+		policy:     config.policy,
+		debounce:   config.debounce,
+		clock:      clock,
+		notify:     make(chan struct{}, 1),
+		space:      make(chan struct{}, 1),
+		done:       make(chan struct{}),
+		pumped:     make(chan struct{}),
+		unsubFn:    unsubFn,
+
+		replaying:   config.replay,
+		replaySince: config.since,
+	}
+	go sub.pump()
+	return sub
+}
+
+// Close ends the subscription. It is safe to call more than once, and from
+// any goroutine. Once it returns, no more changes are delivered.
+func (s *subscription) Close() error {
+	err := s.unsubFn()
+	<-s.pumped
+	return err
+}
+
+func (s *subscription) Changes() <-chan Change {
+	return s.changeCh
+}
+
+func (s *subscription) Batches() <-chan []Change {
+	return s.batchCh
+}
+
+func (s *subscription) Done() <-chan struct{} {
+	return s.pumped
+}
+
+// Err returns the reason the subscription was closed by the queue, if it
+// wasn't closed by the subscriber.
+func (s *subscription) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.err
+}
+
+// setReplayed records the changes replayed to the subscription, so the same
+// changes can be skipped when they come through the change stream.
+func (s *subscription) setReplayed(changes []Change) {
+	s.replayed = make(map[int64]struct{}, len(changes))
+	s.replayHead = s.replaySince
+	for _, ch := range changes {
+		s.replayed[ch.ChangeID()] = struct{}{}
+		if ch.ChangeID() > s.replayHead {
+			s.replayHead = ch.ChangeID()
+		}
+	}
+}
+
+// skipReplayed drops the changes that have already been replayed, or that were
+// made before the replay started. Once a change after the replay comes
+// through, there is nothing left to skip.
+func (s *subscription) skipReplayed(changes []Change) []Change {
+	if s.replayed == nil {
+		return changes
+	}
+
+	var result []Change
+	for _, ch := range changes {
+		if ch.ChangeID() <= s.replaySince {
+			continue
+		}
+		if ch.ChangeID() > s.replayHead {
+			s.replayed = nil
+			result = append(result, ch)
+			continue
+		}
+		if _, ok := s.replayed[ch.ChangeID()]; ok {
+			delete(s.replayed, ch.ChangeID())
+			continue
+		}
+		result = append(result, ch)
+	}
+	return result
+}
+
+// stop ends the subscription. The pump closes the channels on its way out.
+// Only the first call has any effect.
+func (s *subscription) stop(err error) {
+	s.stopOnce.Do(func() {
+		s.mu.Lock()
+		s.err = err
+		s.mu.Unlock()
+
+		close(s.done)
+	})
+}
+
+// enqueue adds the changes to the buffer, applying the overflow policy if
+// there isn't room for them. It returns ErrSlowConsumer if the subscription
+// needs to be killed.
+func (s *subscription) enqueue(dying <-chan struct{}, changes []Change) error {
+	for _, ch := range changes {
+		if err := s.enqueueOne(dying, ch); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *subscription) enqueueOne(dying <-chan struct{}, ch Change) error {
+	for {
+		s.mu.Lock()
+		// A debounced subscriber only ever gets one change per entity, so
+		// the changes are merged as they arrive, rather than filling the
+		// buffer during the window.
+		if s.debounce > 0 && s.coalesce(ch) {
+			s.mu.Unlock()
+			s.wake(s.notify)
+			return nil
+		}
+		if len(s.buffer) < s.bufferSize {
+			s.buffer = append(s.buffer, ch)
+			s.mu.Unlock()
+			s.wake(s.notify)
+			return nil
+		}
+
+		switch s.policy {
+		case DropOldest:
+			s.buffer = append(s.buffer[1:], ch)
+			s.mu.Unlock()
+			s.wake(s.notify)
+			return nil
+
+		case Coalesce:
+			if merged := s.coalesce(ch); merged {
+				s.mu.Unlock()
+				s.wake(s.notify)
+				return nil
+			}
+
+		case Kill:
+			s.mu.Unlock()
+			return ErrSlowConsumer
+		}
+		s.mu.Unlock()
+
+		select {
+		case <-s.space:
+		case <-s.done:
+			return nil
+		case <-dying:
+			return tomb.ErrDying
+		}
+	}
+}
+
+// coalesce merges the change with a buffered change to the same entity, and
+// moves the result to the back of the buffer, as it is now the latest. It must
+// be called with the lock held.
+func (s *subscription) coalesce(ch Change) bool {
+	for i, buffered := range s.buffer {
+		if buffered.EntityType() != ch.EntityType() || buffered.EntityID() != ch.EntityID() {
+			continue
+		}
+
+		merged := mergedChange{
+			Change:     ch,
+			changeType: buffered.Type().Merge(ch.Type()),
+		}
+		s.buffer = append(append(s.buffer[:i], s.buffer[i+1:]...), merged)
+		return true
+	}
+	return false
+}
+
+// pump delivers the buffered changes to the subscriber.
+func (s *subscription) pump() {
+	defer func() {
+		close(s.changeCh)
+		close(s.batchCh)
+		close(s.pumped)
+	}()
+
+	for {
+		batch, ok := s.next()
+		if !ok {
+			return
+		}
+
+		if s.batched {
+			select {
+			case s.batchCh <- batch:
+			case <-s.done:
+				return
+			}
+			s.recordDelivery(len(batch))
+			continue
+		}
+
+		for _, ch := range batch {
+			select {
+			case s.changeCh <- ch:
+			case <-s.done:
+				return
+			}
+			s.recordDelivery(1)
+		}
+	}
+}
+
+// next waits for changes to be buffered, and takes the next ones to deliver
+// out of the buffer. It returns false once the subscription is stopped.
+func (s *subscription) next() ([]Change, bool) {
+	for {
+		s.mu.Lock()
+		if len(s.buffer) > 0 {
+			s.mu.Unlock()
+			break
+		}
+		s.mu.Unlock()
+
+		select {
+		case <-s.notify:
+		case <-s.done:
+			return nil, false
+		}
+	}
+
+	// Let the changes made within the window pile up, so they can be
+	// delivered together.
+	if s.debounce > 0 {
+		select {
+		case <-s.clock.After(s.debounce):
+		case <-s.done:
+			return nil, false
+		}
+	}
+
+	// A batched or debounced subscriber gets everything buffered since the
+	// last time it read, which may span several reads of the change stream,
+	// merged into a single change per entity.
+	s.mu.Lock()
+	var batch []Change
+	gather := s.batched || s.debounce > 0
+	if gather {
+		batch = s.buffer
+		s.buffer = nil
+	} else {
+		batch = s.buffer[:1]
+		s.buffer = s.buffer[1:]
+	}
+	s.mu.Unlock()
+	s.wake(s.space)
+
+	if gather {
+		batch = coalesceChanges(batch)
+	}
+
+	s.mu.Lock()
+	s.inflight = len(batch)
+	s.mu.Unlock()
+
+	return batch, true
+}
+
+func (s *subscription) recordDelivery(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.inflight -= n
+	s.delivered += uint64(n)
+	s.lastDelivery = s.clock.Now()
+}
+
+func (s *subscription) wake(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// coalesceChanges merges every change to the same entity into the latest of
+// them, keeping the order of the latest changes.
+func coalesceChanges(changes []Change) []Change {
+	type entityKey struct {
+		entityType string
+		entityID   string
+	}
+
+	var (
+		results []Change
+		index   = make(map[entityKey]int)
+	)
+	for _, ch := range changes {
+		key := entityKey{
+			entityType: ch.EntityType(),
+			entityID:   ch.EntityID(),
+		}
+		i, ok := index[key]
+		if !ok {
+			index[key] = len(results)
+			results = append(results, ch)
+			continue
+		}
+
+		// Leave a hole where the earlier change was, to be squeezed out at
+		// the end, so the indexes stay valid.
+		results = append(results, mergedChange{
+			Change:     ch,
+			changeType: results[i].Type().Merge(ch.Type()),
+		})
+		results[i] = nil
+		index[key] = len(results) - 1
+	}
+
+	merged := results[:0]
+	for _, ch := range results {
+		if ch != nil {
+			merged = append(merged, ch)
+		}
+	}
+	return merged
+}
+
+// mergedChange is the latest of a run of changes to an entity, carrying the
+// merged type of all of them.
+type mergedChange struct {
+	Change
+	changeType ChangeType
+}
+
+func (c mergedChange) Type() ChangeType {
+	return c.changeType
+}
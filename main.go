@@ -8,9 +8,13 @@ import (
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strconv"
+	"time"
 
 	"github.com/SimonRichardson/nu-juju-watchers/changestream"
+	dbretry "github.com/SimonRichardson/nu-juju-watchers/db"
 	"github.com/SimonRichardson/nu-juju-watchers/eventqueue"
+	"github.com/SimonRichardson/nu-juju-watchers/metrics"
 	"github.com/SimonRichardson/nu-juju-watchers/repl"
 	"github.com/SimonRichardson/nu-juju-watchers/server"
 	"github.com/SimonRichardson/nu-juju-watchers/watcher"
@@ -37,6 +41,8 @@ func doItLive() {
 	var join *[]string
 	var dir string
 	var verbose bool
+	var maxPollInterval time.Duration
+	var dispatchWorkers int
 
 	cmd := &cobra.Command{
 		Use:   "nu-juju-watcher",
@@ -66,28 +72,49 @@ func doItLive() {
 				return err
 			}
 
+			// Create the write ahead log watcher. This will notify any changes
+			// that have occurred in the log.
+			stream := changestream.New(db,
+				changestream.WithClock(clock.WallClock),
+				changestream.WithBackoff(changestream.NewAdaptiveBackoff(changestream.MinPollInterval, maxPollInterval)),
+				changestream.WithDurableCursor(strconv.FormatUint(app.ID(), 10), "watchers"),
+				changestream.WithStart(changestream.StartFromStored()),
+				changestream.WithBatchDelivery(),
+			)
+			defer stream.Close()
+
+			// Only the leader prunes the change log, once every live stream
+			// has read the changes.
+			pruner := changestream.NewPruner(db,
+				changestream.WithLeaderCheck(func() (bool, error) {
+					return isLeader(app)
+				}),
+				changestream.WithMaxAge(time.Hour*24),
+			)
+			defer pruner.Close()
+
+			eventQueue := eventqueue.New(stream,
+				eventqueue.WithParallelDispatch(dispatchWorkers),
+			)
+			defer eventQueue.Close()
+
 			replSock := filepath.Join(dir, "juju.sock")
 			_ = os.Remove(replSock)
-			_, err = repl.New(replSock, dbGetter{db: db}, clock.WallClock)
+			_, err = repl.New(replSock, dbGetter{db: db}, eventQueue, clock.WallClock)
 			if err != nil {
 				return err
 			}
 
 			// Create the server for adding new items to the database
-			server := server.New(db)
+			server := server.New(db,
+				server.WithMetrics(stream, pruner, metrics.CollectorFunc(collectDBMetrics)),
+				server.WithEventQueue(eventQueue),
+			)
 			listener, err := server.Serve(api)
 			if err != nil {
 				return err
 			}
 
-			// Create the write ahead log watcher. This will notify any changes
-			// that have occurred in the log.
-			stream := changestream.New(db)
-			defer stream.Close()
-
-			eventQueue := eventqueue.New(stream)
-			defer eventQueue.Close()
-
 			// The NewModelConfigWatcher will take those changes and emit the
 			// model configs based on any changes.
 			modelConfigWatcher := watcher.NewModelConfigWatcher(db, eventQueue)
@@ -96,6 +123,9 @@ func doItLive() {
 			stringsWatcher := watcher.NewModelConfigKeyWatcher(db, eventQueue)
 			defer stringsWatcher.Close()
 
+			keyValueWatcher := watcher.NewModelConfigKeyValueWatcher(db, eventQueue, "agent-version", "logging-config")
+			defer keyValueWatcher.Close()
+
 			done := make(chan struct{}, 1)
 			go func() {
 				for {
@@ -110,6 +140,9 @@ func doItLive() {
 
 					case change := <-stringsWatcher.Changes():
 						fmt.Printf("%s: Changes from strings watcher: %v\n", dir, change)
+
+					case change := <-keyValueWatcher.Changes():
+						fmt.Printf("%s: Changes from key value watcher: %v\n", dir, change)
 					}
 				}
 			}()
@@ -143,6 +176,8 @@ func doItLive() {
 	join = flags.StringSliceP("join", "j", nil, "database addresses of existing nodes")
 	flags.StringVarP(&dir, "dir", "D", "/tmp/dqlite-demo", "data directory")
 	flags.BoolVarP(&verbose, "verbose", "v", false, "verbose logging")
+	flags.DurationVar(&maxPollInterval, "max-poll-interval", changestream.MaxPollInterval, "maximum interval between polls of an idle change log")
+	flags.IntVar(&dispatchWorkers, "dispatch-workers", 1, "number of workers dispatching changes to subscriptions")
 
 	cmd.MarkFlagRequired("api")
 	cmd.MarkFlagRequired("db")
@@ -152,6 +187,28 @@ func doItLive() {
 	}
 }
 
+func collectDBMetrics(mw *metrics.Writer) error {
+	mw.Counter("db_retries_total", "The number of retried database operations.", float64(dbretry.Retries()))
+	return mw.Err()
+}
+
+func isLeader(app *app.App) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	cli, err := app.Leader(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer cli.Close()
+
+	leader, err := cli.Leader(ctx)
+	if err != nil {
+		return false, err
+	}
+	return leader != nil && leader.ID == app.ID(), nil
+}
+
 type dbGetter struct {
 	db *sql.DB
 }
@@ -0,0 +1,50 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// Collector writes its metrics out whenever they're scraped.
+type Collector interface {
+	Collect(w *Writer) error
+}
+
+// CollectorFunc adapts a function to a Collector.
+type CollectorFunc func(w *Writer) error
+
+func (f CollectorFunc) Collect(w *Writer) error {
+	return f(w)
+}
+
+// Writer writes metrics in the Prometheus text exposition format. The first
+// write error is kept and every write after it is dropped.
+type Writer struct {
+	w   io.Writer
+	err error
+}
+
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w}
+}
+
+func (w *Writer) Gauge(name, help string, value float64) {
+	w.write(name, "gauge", help, value)
+}
+
+func (w *Writer) Counter(name, help string, value float64) {
+	w.write(name, "counter", help, value)
+}
+
+func (w *Writer) Err() error {
+	return w.err
+}
+
+func (w *Writer) write(name, kind, help string, value float64) {
+	if w.err != nil {
+		return
+	}
+	_, w.err = fmt.Fprintf(w.w, "# HELP %s %s\n# TYPE %s %s\n%s %s\n",
+		name, help, name, kind, name, strconv.FormatFloat(value, 'g', -1, 64))
+}
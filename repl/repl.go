@@ -13,6 +13,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/SimonRichardson/nu-juju-watchers/eventqueue"
 	"github.com/juju/clock"
 	"github.com/juju/collections/set"
 	"github.com/juju/errors"
@@ -25,6 +26,11 @@ type DBGetter interface {
 	GetExistingDB(string) (*sql.DB, error)
 }
 
+// SubscriptionLister lists the subscriptions to an event queue.
+type SubscriptionLister interface {
+	Subscriptions() []eventqueue.SubscriptionInfo
+}
+
 type replSession struct {
 	id string
 	db *sql.DB
@@ -43,6 +49,7 @@ type replCmdDef struct {
 type SQLRepl struct {
 	connListener net.Listener
 	dbGetter     DBGetter
+	subLister    SubscriptionLister
 	clock        clock.Clock
 
 	sessionCtx      context.Context
@@ -52,7 +59,7 @@ type SQLRepl struct {
 	commands map[string]replCmdDef
 }
 
-func New(pathToSocket string, dbGetter DBGetter, clock clock.Clock) (*SQLRepl, error) {
+func New(pathToSocket string, dbGetter DBGetter, subLister SubscriptionLister, clock clock.Clock) (*SQLRepl, error) {
 	l, err := net.Listen("unix", pathToSocket)
 	if err != nil {
 		return nil, errors.Annotate(err, "creating UNIX socket for REPL sessions")
@@ -63,6 +70,7 @@ func New(pathToSocket string, dbGetter DBGetter, clock clock.Clock) (*SQLRepl, e
 	r := &SQLRepl{
 		connListener:    l,
 		dbGetter:        dbGetter,
+		subLister:       subLister,
 		clock:           clock,
 		sessionCtx:      ctx,
 		sessionCancelFn: cancelFn,
@@ -96,6 +104,10 @@ func (r *SQLRepl) registerCommands() {
 			descr:   "connect to a database (e.g. '.open foo')",
 			handler: r.handleOpenCommand,
 		},
+		".subscriptions": {
+			descr:   "list the subscriptions to the event queue",
+			handler: r.handleSubscriptionsCommand,
+		},
 	}
 }
 
@@ -230,6 +242,33 @@ func (r *SQLRepl) handleOpenCommand(s *replSession) {
 	_, _ = fmt.Fprintf(s.resWriter, "You are now connected to DB %q\n", s.cmdParams)
 }
 
+func (r *SQLRepl) handleSubscriptionsCommand(s *replSession) {
+	if r.subLister == nil {
+		_, _ = fmt.Fprintf(s.resWriter, "No event queue to list the subscriptions of\n")
+		return
+	}
+
+	subs := r.subLister.Subscriptions()
+	_, _ = fmt.Fprintf(s.resWriter, "ID\tTopics\tQueue depth\tDelivered\tLast delivery\n")
+	for _, sub := range subs {
+		topics := make([]string, len(sub.Topics))
+		for i, topic := range sub.Topics {
+			topics[i] = fmt.Sprintf("%s(%s)", topic.EntityType, topic.ChangeMask)
+			if topic.Filtered {
+				topics[i] += "+filter"
+			}
+		}
+
+		lastDelivery := "never"
+		if !sub.LastDelivery.IsZero() {
+			lastDelivery = sub.LastDelivery.UTC().Format(time.RFC3339)
+		}
+		_, _ = fmt.Fprintf(s.resWriter, "%d\t%s\t%d\t%d\t%s\n", sub.ID, strings.Join(topics, ","), sub.QueueDepth, sub.Delivered, lastDelivery)
+	}
+
+	_, _ = fmt.Fprintf(s.resWriter, "\nTotal subscriptions: %d\n", len(subs))
+}
+
 func (r *SQLRepl) handleInsert(s *replSession) {
 	if s.db == nil {
 		_, _ = fmt.Fprintf(s.resWriter, "Not connected to a database; use '.open' followed by the model UUID to connect to\n")
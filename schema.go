@@ -13,26 +13,48 @@ CREATE TABLE IF NOT EXISTS change_log (
 	id INTEGER PRIMARY KEY AUTOINCREMENT,
 	type INTEGER, 
 	entity_type TEXT, 
-	entity_id INTEGER, 
+	entity_id TEXT, 
 	created_at DATETIME
 );
 
-CREATE TRIGGER IF NOT EXISTS insert_model_config_trigger
+CREATE TABLE IF NOT EXISTS change_log_cursor (
+	node_id TEXT,
+	stream TEXT,
+	cursor_id INTEGER,
+	updated_at DATETIME,
+	PRIMARY KEY(node_id, stream)
+);
+
+-- The model_config entities are identified by their keys. The triggers are
+-- recreated every time, so older databases pick up the current ones.
+DROP TRIGGER IF EXISTS insert_model_config_trigger;
+CREATE TRIGGER insert_model_config_trigger
 AFTER INSERT ON model_config FOR EACH ROW
 BEGIN
-	INSERT INTO change_log (type, entity_type, entity_id, created_at) VALUES (1, "model_config", NEW.id, DATETIME('now'));
+	INSERT INTO change_log (type, entity_type, entity_id, created_at) VALUES (1, "model_config", NEW.key, DATETIME('now'));
+END;
+
+DROP TRIGGER IF EXISTS update_model_config_trigger;
+CREATE TRIGGER update_model_config_trigger
+AFTER UPDATE ON model_config FOR EACH ROW WHEN OLD.key = NEW.key
+BEGIN
+	INSERT INTO change_log (type, entity_type, entity_id, created_at) VALUES (2, "model_config", NEW.key, DATETIME('now'));
 END;
 
-CREATE TRIGGER IF NOT EXISTS update_model_config_trigger
-AFTER UPDATE ON model_config FOR EACH ROW
+-- Renaming a key removes the old entity and creates a new one.
+DROP TRIGGER IF EXISTS rename_model_config_trigger;
+CREATE TRIGGER rename_model_config_trigger
+AFTER UPDATE ON model_config FOR EACH ROW WHEN OLD.key != NEW.key
 BEGIN
-	INSERT INTO change_log (type, entity_type, entity_id, created_at) VALUES (2, "model_config", OLD.id, DATETIME('now'));
+	INSERT INTO change_log (type, entity_type, entity_id, created_at) VALUES (4, "model_config", OLD.key, DATETIME('now'));
+	INSERT INTO change_log (type, entity_type, entity_id, created_at) VALUES (1, "model_config", NEW.key, DATETIME('now'));
 END;
 
-CREATE TRIGGER IF NOT EXISTS delete_model_config_trigger
+DROP TRIGGER IF EXISTS delete_model_config_trigger;
+CREATE TRIGGER delete_model_config_trigger
 AFTER DELETE ON model_config FOR EACH ROW
 BEGIN
-	INSERT INTO change_log (type, entity_type, entity_id, created_at) VALUES (4, "model_config", OLD.id, DATETIME('now'));
+	INSERT INTO change_log (type, entity_type, entity_id, created_at) VALUES (4, "model_config", OLD.key, DATETIME('now'));
 END;
 `
 )
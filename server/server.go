@@ -1,6 +1,7 @@
 package server
 
 import (
+	"bytes"
 	"context"
 	"database/sql"
 	"fmt"
@@ -10,17 +11,37 @@ import (
 	"strings"
 
 	"github.com/SimonRichardson/nu-juju-watchers/db"
+	"github.com/SimonRichardson/nu-juju-watchers/metrics"
 )
 
 type Server struct {
-	db *sql.DB
+	db         *sql.DB
+	metrics    []metrics.Collector
+	eventQueue EventQueue
 }
 
-func New(db *sql.DB) *Server {
-	return &Server{db: db}
+type Option func(*Server)
+
+// WithMetrics serves the metrics of the collectors from /metrics, in the
+// Prometheus text format.
+func WithMetrics(collectors ...metrics.Collector) Option {
+	return func(s *Server) {
+		s.metrics = append(s.metrics, collectors...)
+	}
+}
+
+func New(db *sql.DB, opts ...Option) *Server {
+	s := &Server{db: db}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
 }
 
 func (s Server) Serve(address string) (net.Listener, error) {
+	http.HandleFunc("/metrics", s.serveMetrics)
+	http.HandleFunc("/subscribe", s.serveSubscribe)
+	http.HandleFunc("/debug/subscriptions", s.serveSubscriptions)
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		ctx := r.Context()
 		key := strings.TrimLeft(r.URL.Path, "/")
@@ -77,6 +98,29 @@ func (s Server) Serve(address string) (net.Listener, error) {
 	return listener, err
 }
 
+func (s Server) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Error: unsupported method %q\n", r.Method)
+		return
+	}
+
+	// Write to a buffer first, so a failing collector doesn't leave a
+	// partial scrape behind.
+	var buf bytes.Buffer
+	mw := metrics.NewWriter(&buf)
+	for _, collector := range s.metrics {
+		if err := collector.Collect(mw); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintln(w, err.Error())
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	_, _ = buf.WriteTo(w)
+}
+
 const (
 	query  = "SELECT id, key, value FROM model_config WHERE key = ?"
 	update = "INSERT OR REPLACE INTO model_config(key, value) VALUES(?, ?) ON CONFLICT(key) DO UPDATE SET value=excluded.value"
@@ -0,0 +1,132 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/SimonRichardson/nu-juju-watchers/eventqueue"
+)
+
+type EventQueue interface {
+	Subscribe(ctx context.Context, opts ...eventqueue.SubscriptionOption) (eventqueue.Subscription, error)
+	Subscriptions() []eventqueue.SubscriptionInfo
+}
+
+// WithEventQueue lets remote clients subscribe to the changes of the queue,
+// through /subscribe, and lists its subscriptions on /debug/subscriptions.
+func WithEventQueue(queue EventQueue) Option {
+	return func(s *Server) {
+		s.eventQueue = queue
+	}
+}
+
+// subscribeRequest is the body of a request to /subscribe, such as:
+//
+//	{"topics": [{"entity-type": "model_config", "change-mask": "cud",
+//	  "filter": {"entity-ids": ["1", "2"], "change-types": "u"}}]}
+type subscribeRequest struct {
+	Topics []subscribeTopic `json:"topics"`
+}
+
+type subscribeTopic struct {
+	EntityType string                `json:"entity-type"`
+	ChangeMask eventqueue.ChangeType `json:"change-mask"`
+	Filter     *eventqueue.Filter    `json:"filter,omitempty"`
+}
+
+type subscribeChange struct {
+	ChangeID   int64                 `json:"change-id"`
+	Type       eventqueue.ChangeType `json:"type"`
+	EntityType string                `json:"entity-type"`
+	EntityID   string                `json:"entity-id"`
+	Timestamp  time.Time             `json:"timestamp"`
+}
+
+// serveSubscribe streams the changes matching the topics of the request, as
+// one JSON object per line, until the client goes away.
+func (s Server) serveSubscribe(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Error: unsupported method %q\n", r.Method)
+		return
+	}
+	if s.eventQueue == nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintln(w, "Error: no event queue")
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintln(w, "Error: streaming unsupported")
+		return
+	}
+
+	var req subscribeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Error: %v\n", err)
+		return
+	}
+
+	// A remote client must never hold up the queue, so it is cut off as soon
+	// as it falls behind.
+	opts := []eventqueue.SubscriptionOption{
+		eventqueue.OnOverflow(eventqueue.Kill),
+	}
+	for _, topic := range req.Topics {
+		if topic.Filter != nil {
+			opts = append(opts, eventqueue.FilterTopic(topic.EntityType, topic.ChangeMask, *topic.Filter))
+			continue
+		}
+		opts = append(opts, eventqueue.Topic(topic.EntityType, topic.ChangeMask))
+	}
+
+	// The subscription ends when the client goes away.
+	sub, err := s.eventQueue.Subscribe(r.Context(), opts...)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Error: %v\n", err)
+		return
+	}
+	defer sub.Close()
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	enc := json.NewEncoder(w)
+	for ch := range sub.Changes() {
+		if err := enc.Encode(subscribeChange{
+			ChangeID:   ch.ChangeID(),
+			Type:       ch.Type(),
+			EntityType: ch.EntityType(),
+			EntityID:   ch.EntityID(),
+			Timestamp:  ch.Timestamp(),
+		}); err != nil {
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+func (s Server) serveSubscriptions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Error: unsupported method %q\n", r.Method)
+		return
+	}
+	if s.eventQueue == nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintln(w, "Error: no event queue")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(s.eventQueue.Subscriptions())
+}
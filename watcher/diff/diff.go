@@ -1,63 +1,87 @@
 package diff
 
 import (
+	"context"
 	"database/sql"
+	"fmt"
+	"strings"
 
 	"github.com/SimonRichardson/nu-juju-watchers/eventqueue"
+	"github.com/SimonRichardson/nu-juju-watchers/watcher"
 	"gopkg.in/tomb.v2"
 )
 
 type EventQueue interface {
-	Subscribe(opts ...eventqueue.SubscriptionOption) (eventqueue.Subscription, error)
+	Subscribe(ctx context.Context, opts ...eventqueue.SubscriptionOption) (eventqueue.Subscription, error)
 }
 
-type ModelConfigValue struct {
-	ID    int64
-	Key   string
-	Value string
+// Change is what happened to a row, as the value made of it by the MapFunc of
+// the watcher. The value of a removal is the last one known.
+type Change struct {
+	Kind  watcher.ChangeKind
+	Value interface{}
 }
 
-type ModelConfigWatcher struct {
+// MapFunc maps a row, keyed by column name, to the value being watched.
+type MapFunc func(row map[string]interface{}) (interface{}, error)
+
+// TableWatcher watches the rows of a table. The first event holds every row as
+// added, and is sent even if there are none. After that, each row that is
+// added, changed or removed is sent as it happens.
+type TableWatcher struct {
 	tomb tomb.Tomb
 
+	table      string
 	eventQueue EventQueue
 	differ     differ
-	out        chan []ModelConfigValue
+	mapFn      MapFunc
+	out        chan []Change
 }
 
-func NewModelConfigWatcher(db *sql.DB, eventQueue EventQueue) *ModelConfigWatcher {
-	watcher := &ModelConfigWatcher{
-		out:        make(chan []ModelConfigValue),
+// NewTableWatcher watches the table, whose rows are identified by the primary
+// key columns. The entity IDs in the change_log for the table must be the
+// values of the columns, joined by eventqueue.CompositeKey if there is more
+// than one.
+func NewTableWatcher(db *sql.DB, eventQueue EventQueue, table string, pkColumns []string, mapFn MapFunc) *TableWatcher {
+	watcher := &TableWatcher{
+		table:      table,
 		eventQueue: eventQueue,
+		mapFn:      mapFn,
+		out:        make(chan []Change),
+	}
+
+	conditions := make([]string, len(pkColumns))
+	for i, column := range pkColumns {
+		conditions[i] = column + " = ?"
 	}
 
 	watcher.differ = differ{
-		pkFieldName: "id",
-		findOneFn:   makeFindOneFn(db, query),
-		findAllFn:   makeFindAllFn(db, queryAll),
-		tomb:        watcher.tomb,
-		out:         make(chan entityMap),
+		pkFieldNames: pkColumns,
+		findOneFn:    makeFindOneFn(db, fmt.Sprintf(queryOne, table, strings.Join(conditions, " AND ")), len(pkColumns)),
+		findAllFn:    makeFindAllFn(db, fmt.Sprintf(queryAll, table)),
+		tomb:         &watcher.tomb,
+		out:          make(chan []entityChange),
 	}
 
 	watcher.tomb.Go(watcher.loop)
 	return watcher
 }
 
-func (w *ModelConfigWatcher) Changes() <-chan []ModelConfigValue {
+func (w *TableWatcher) Changes() <-chan []Change {
 	return w.out
 }
 
-func (w *ModelConfigWatcher) Wait() <-chan struct{} {
+func (w *TableWatcher) Wait() <-chan struct{} {
 	return w.tomb.Dead()
 }
 
-func (w *ModelConfigWatcher) Close() error {
+func (w *TableWatcher) Close() error {
 	w.tomb.Kill(nil)
 	return w.tomb.Wait()
 }
 
-func (w *ModelConfigWatcher) loop() error {
-	subscription, err := w.eventQueue.Subscribe(eventqueue.Topic("model_config", eventqueue.Create|eventqueue.Update|eventqueue.Delete))
+func (w *TableWatcher) loop() error {
+	subscription, err := w.eventQueue.Subscribe(w.tomb.Context(nil), eventqueue.Topic(w.table, eventqueue.Create|eventqueue.Update|eventqueue.Delete))
 	if err != nil {
 		return err
 	}
@@ -72,13 +96,21 @@ func (w *ModelConfigWatcher) loop() error {
 		case <-w.tomb.Dying():
 			return tomb.ErrDying
 
-		case entMap, ok := <-w.differ.out:
+		case entityChanges, ok := <-w.differ.out:
 			if !ok {
 				return nil
 			}
 
+			changes := make([]Change, len(entityChanges))
+			for i, change := range entityChanges {
+				value, err := w.mapFn(change.entity)
+				if err != nil {
+					return err
+				}
+				changes[i] = Change{Kind: change.kind, Value: value}
+			}
+
 			// Push change(s)
-			changes := []ModelConfigValue{mapModelConfig(entMap)}
 			select {
 			case <-w.tomb.Dying():
 				return tomb.ErrDying
@@ -88,15 +120,79 @@ func (w *ModelConfigWatcher) loop() error {
 	}
 }
 
-func mapModelConfig(data entityMap) ModelConfigValue {
-	return ModelConfigValue{
-		ID:    data["id"].(int64),
-		Key:   data["key"].(string),
-		Value: data["value"].(string),
+const (
+	queryOne = "SELECT * FROM %s WHERE %s"
+	queryAll = "SELECT * FROM %s"
+)
+
+type ModelConfigValue struct {
+	ID    int64  `db:"id"`
+	Key   string `db:"key"`
+	Value string `db:"value"`
+}
+
+type ModelConfigChange struct {
+	Kind  watcher.ChangeKind
+	Value ModelConfigValue
+}
+
+// ModelConfigWatcher is the TableWatcher of model_config, with the values
+// typed as ModelConfigValues.
+type ModelConfigWatcher struct {
+	tomb tomb.Tomb
+
+	watcher *TableWatcher
+	out     chan []ModelConfigChange
+}
+
+func NewModelConfigWatcher(db *sql.DB, eventQueue EventQueue) *ModelConfigWatcher {
+	watcher := &ModelConfigWatcher{
+		watcher: NewTableWatcher(db, eventQueue, "model_config", []string{"key"}, MapStruct(ModelConfigValue{})),
+		out:     make(chan []ModelConfigChange),
 	}
+
+	watcher.tomb.Go(watcher.loop)
+	return watcher
 }
 
-const (
-	query    = "SELECT id, key, value FROM model_config WHERE id = ?"
-	queryAll = "SELECT id, key, value FROM model_config"
-)
+func (w *ModelConfigWatcher) Changes() <-chan []ModelConfigChange {
+	return w.out
+}
+
+func (w *ModelConfigWatcher) Wait() <-chan struct{} {
+	return w.tomb.Dead()
+}
+
+func (w *ModelConfigWatcher) Close() error {
+	w.tomb.Kill(nil)
+	return w.tomb.Wait()
+}
+
+func (w *ModelConfigWatcher) loop() error {
+	defer w.watcher.Close()
+
+	for {
+		select {
+		case <-w.tomb.Dying():
+			return tomb.ErrDying
+
+		case <-w.watcher.Wait():
+			return w.watcher.Close()
+
+		case tableChanges := <-w.watcher.Changes():
+			changes := make([]ModelConfigChange, len(tableChanges))
+			for i, change := range tableChanges {
+				changes[i] = ModelConfigChange{
+					Kind:  change.Kind,
+					Value: change.Value.(ModelConfigValue),
+				}
+			}
+
+			select {
+			case <-w.tomb.Dying():
+				return tomb.ErrDying
+			case w.out <- changes:
+			}
+		}
+	}
+}
@@ -3,32 +3,45 @@ package diff
 import (
 	"database/sql"
 	"fmt"
+	"strconv"
 
 	dbretry "github.com/SimonRichardson/nu-juju-watchers/db"
 	"github.com/SimonRichardson/nu-juju-watchers/eventqueue"
+	"github.com/SimonRichardson/nu-juju-watchers/watcher"
+	"github.com/juju/errors"
 	"gopkg.in/tomb.v2"
 )
 
 type entityMap map[string]interface{}
 
+// entityChange is what happened to an entity, with the last known state of
+// the entity if it was removed.
+type entityChange struct {
+	kind   watcher.ChangeKind
+	entity entityMap
+}
+
 type differ struct {
-	entityStore map[int64]entityMap
+	entityStore map[string]entityMap
 
-	pkFieldName string
-	findOneFn   func(int64) (entityMap, error)
-	findAllFn   func() ([]entityMap, error)
+	// pkFieldNames are the columns making up the primary key, in the order
+	// the entity ID joins them.
+	pkFieldNames []string
+	findOneFn    func(string) (entityMap, error)
+	findAllFn    func() ([]entityMap, error)
 
 	// A subscription provided by the embedding worker; its lifecycle is managed
 	// by the embedder.
 	subscription eventqueue.Subscription
 
-	tomb tomb.Tomb
+	// The tomb of the embedding worker, the differ runs as part of it.
+	tomb *tomb.Tomb
 	// @Simon: we should just simplify and push single entities from all watchers
 	// if the consumer wants parallelism they can do that manually (see provisioner task changes)
-	out chan entityMap
+	out chan []entityChange
 }
 
-func (w *differ) Changes() <-chan entityMap {
+func (w *differ) Changes() <-chan []entityChange {
 	return w.out
 }
 
@@ -43,17 +56,21 @@ func (w *differ) Close() error {
 
 func (w *differ) loop() error {
 	// Populate store with initial state.
-	if err := w.initialize(); err != nil {
+	entities, err := w.initialize()
+	if err != nil {
 		return err
 	}
 
-	// Push initial state out.
-	for _, ent := range w.entityStore {
-		select {
-		case <-w.tomb.Dying():
-			return tomb.ErrDying
-		case w.out <- ent:
-		}
+	// Push initial state out, all in one go so the consumer knows when it has
+	// all of it, even if there is nothing.
+	initial := make([]entityChange, len(entities))
+	for i, ent := range entities {
+		initial[i] = entityChange{kind: watcher.Added, entity: ent}
+	}
+	select {
+	case <-w.tomb.Dying():
+		return tomb.ErrDying
+	case w.out <- initial:
 	}
 
 	for {
@@ -63,85 +80,142 @@ func (w *differ) loop() error {
 
 		case c, ok := <-w.subscription.Changes():
 			if !ok {
-				return nil
+				// Pass on why the subscription ended, unless we're the
+				// reason it did.
+				select {
+				case <-w.tomb.Dying():
+					return tomb.ErrDying
+				default:
+				}
+				return w.subscription.Err()
 			}
 
-			updatedEnt, err := w.processChange(c)
+			change, ok, err := w.processChange(c)
 			if err != nil {
 				fmt.Println("err", err)
 				return err
 			}
 
-			if updatedEnt == nil || c.Type() == eventqueue.Delete {
-				continue // no change or delete (TBD)
+			if !ok {
+				continue // no change
 			}
 
 			// Push changed entity.
 			select {
 			case <-w.tomb.Dying():
 				return tomb.ErrDying
-			case w.out <- updatedEnt:
+			case w.out <- []entityChange{change}:
 			}
 		}
 	}
 }
 
-func (w *differ) initialize() error {
-	w.entityStore = make(map[int64]entityMap)
+// initialize populates the store with every entity, and returns them in the
+// order they were read.
+func (w *differ) initialize() ([]entityMap, error) {
+	w.entityStore = make(map[string]entityMap)
 
 	entities, err := w.findAllFn()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	for _, ent := range entities {
-		w.entityStore[ent[w.pkFieldName].(int64)] = ent
+		pk, err := w.primaryKey(ent)
+		if err != nil {
+			return nil, err
+		}
+		w.entityStore[pk] = ent
 	}
 
-	return nil
+	return entities, nil
+}
+
+// primaryKey returns the entity ID of the entity, as the change_log has it.
+func (w *differ) primaryKey(ent entityMap) (string, error) {
+	parts := make([]string, len(w.pkFieldNames))
+	for i, name := range w.pkFieldNames {
+		switch v := ent[name].(type) {
+		case int64:
+			parts[i] = strconv.FormatInt(v, 10)
+		case string:
+			parts[i] = v
+		default:
+			return "", errors.Errorf("primary key column %q is %T, not an integer or text", name, v)
+		}
+	}
+	return eventqueue.CompositeKey(parts...), nil
 }
 
-func (w *differ) processChange(change eventqueue.Change) (entityMap, error) {
+func (w *differ) processChange(change eventqueue.Change) (entityChange, bool, error) {
 	entID := change.EntityID()
+	oldEnt, known := w.entityStore[entID]
 
 	if (change.Type() & eventqueue.Delete) != 0 {
-		oldEnt := w.entityStore[entID]
-		delete(w.entityStore, entID)
-		return oldEnt, nil
+		return w.remove(entID, oldEnt, known)
 	}
 
-	oldEnt := w.entityStore[entID]
-	newEnt, err := w.findOneFn(entID) // TODO: handle sql.ErrNoRows
+	newEnt, err := w.findOneFn(entID)
 	if err != nil {
-		return nil, err
+		return entityChange{}, false, err
+	}
+
+	// The entity has gone since the change was made, the delete is on its
+	// way, but there's no need to wait for it.
+	if newEnt == nil {
+		return w.remove(entID, oldEnt, known)
+	}
+
+	if !known {
+		w.entityStore[entID] = newEnt
+		return entityChange{kind: watcher.Added, entity: newEnt}, true, nil
 	}
 
 	if len(oldEnt) != len(newEnt) {
 		w.entityStore[entID] = newEnt
-		return newEnt, nil
+		return entityChange{kind: watcher.Changed, entity: newEnt}, true, nil
 	}
 
 	// Compare keys
 	for sKey, sVal := range oldEnt {
 		if newEnt[sKey] != sVal {
 			w.entityStore[entID] = newEnt
-			return newEnt, nil
+			return entityChange{kind: watcher.Changed, entity: newEnt}, true, nil
 		}
 	}
 	for sKey, sVal := range newEnt {
 		if oldEnt[sKey] != sVal {
 			w.entityStore[entID] = newEnt
-			return newEnt, nil
+			return entityChange{kind: watcher.Changed, entity: newEnt}, true, nil
 		}
 	}
 
-	return nil, nil // no change detected
+	return entityChange{}, false, nil // no change detected
+}
+
+// remove drops the entity from the store. Only the removal of an entity we
+// know about is reported.
+func (w *differ) remove(entID string, oldEnt entityMap, known bool) (entityChange, bool, error) {
+	if !known {
+		return entityChange{}, false, nil
+	}
+	delete(w.entityStore, entID)
+	return entityChange{kind: watcher.Removed, entity: oldEnt}, true, nil
 }
 
-func makeFindOneFn(db *sql.DB, query string) func(int64) (entityMap, error) {
-	return func(pk int64) (entityMap, error) {
+func makeFindOneFn(db *sql.DB, query string, pkColumns int) func(string) (entityMap, error) {
+	return func(entID string) (entityMap, error) {
+		parts := eventqueue.SplitKey(entID)
+		if len(parts) != pkColumns {
+			return nil, errors.Errorf("entity ID %q has %d parts, the primary key has %d", entID, len(parts), pkColumns)
+		}
+		args := make([]interface{}, len(parts))
+		for i, part := range parts {
+			args[i] = part
+		}
+
 		ent, err := dbretry.WithRetryWithResult(func() (interface{}, error) {
-			rs, err := db.Query(query, pk)
+			rs, err := db.Query(query, args...)
 			if err != nil {
 				if err == sql.ErrNoRows {
 					return nil, nil
@@ -156,7 +230,7 @@ func makeFindOneFn(db *sql.DB, query string) func(int64) (entityMap, error) {
 			}
 
 			for rs.Next() {
-				return scanModelConfigMap(columns, rs.Scan)
+				return scanEntityMap(columns, rs.Scan)
 			}
 			return nil, nil
 		})
@@ -191,7 +265,7 @@ func makeFindAllFn(db *sql.DB, query string) func() ([]entityMap, error) {
 
 			var entList []entityMap
 			for rs.Next() {
-				ent, err := scanModelConfigMap(colMeta, rs.Scan)
+				ent, err := scanEntityMap(colMeta, rs.Scan)
 				if err != nil {
 					return nil, err
 				}
@@ -209,7 +283,7 @@ func makeFindAllFn(db *sql.DB, query string) func() ([]entityMap, error) {
 	}
 }
 
-func scanModelConfigMap(colNames []string, scanFn func(...interface{}) error) (entityMap, error) {
+func scanEntityMap(colNames []string, scanFn func(...interface{}) error) (entityMap, error) {
 	fieldList := make([]interface{}, len(colNames))
 	for i := 0; i < len(fieldList); i++ {
 		var field interface{}
@@ -222,7 +296,13 @@ func scanModelConfigMap(colNames []string, scanFn func(...interface{}) error) (e
 
 	ent := make(entityMap)
 	for i, colName := range colNames {
-		ent[colName] = *(fieldList[i].(*interface{}))
+		value := *(fieldList[i].(*interface{}))
+		// Blobs are kept as strings, so entities can be compared; a slice
+		// can't be. The mapper turns them back into bytes where needed.
+		if b, ok := value.([]byte); ok {
+			value = string(b)
+		}
+		ent[colName] = value
 	}
 	return ent, nil
 }
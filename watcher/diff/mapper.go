@@ -0,0 +1,215 @@
+package diff
+
+import (
+	"database/sql"
+	"reflect"
+	"strconv"
+	"time"
+
+	"github.com/SimonRichardson/nu-juju-watchers/db"
+	"github.com/juju/errors"
+)
+
+// MapStruct returns a MapFunc filling in structs of the same type as the
+// example, from the columns named by the db tags of their fields. Columns
+// without a field are ignored. The values are structs, or pointers to structs
+// if the example is a pointer.
+//
+// The column values are converted to the types of the fields where it is
+// safe to do so:
+//   - NULL leaves the field as its zero value, or nil for a pointer.
+//   - fields implementing sql.Scanner, such as sql.NullString, scan the value.
+//   - integers widen to any integer or float field they fit into.
+//   - booleans can be read from integers, and from text such as "true".
+//   - times can be read from text in the formats sqlite writes them in.
+//   - text and blobs are interchangeable.
+//
+// Anything else is an error, naming the column. Like an example that isn't a
+// struct, a db tag on an unexported field is a panic, as it can never be set.
+func MapStruct(example interface{}) MapFunc {
+	structType := reflect.TypeOf(example)
+	isPtr := structType.Kind() == reflect.Ptr
+	if isPtr {
+		structType = structType.Elem()
+	}
+	if structType.Kind() != reflect.Struct {
+		panic(errors.Errorf("mapping rows to %T, not a struct", example))
+	}
+
+	fields := make(map[string]int)
+	for i := 0; i < structType.NumField(); i++ {
+		field := structType.Field(i)
+		tag := field.Tag.Get("db")
+		if tag == "" || tag == "-" {
+			continue
+		}
+		// An unexported field can't be set, so it would fail every row.
+		if field.PkgPath != "" {
+			panic(errors.Errorf("mapping column %q to unexported field %s.%s", tag, structType.Name(), field.Name))
+		}
+		fields[tag] = i
+	}
+
+	return func(row map[string]interface{}) (interface{}, error) {
+		value := reflect.New(structType)
+		for column, data := range row {
+			i, ok := fields[column]
+			if !ok {
+				continue
+			}
+
+			field := value.Elem().Field(i)
+			if err := assign(field, data); err != nil {
+				return nil, errors.Annotatef(err, "mapping column %q to %s.%s", column, structType.Name(), structType.Field(i).Name)
+			}
+		}
+
+		if isPtr {
+			return value.Interface(), nil
+		}
+		return value.Elem().Interface(), nil
+	}
+}
+
+var (
+	scannerType = reflect.TypeOf((*sql.Scanner)(nil)).Elem()
+	timeType    = reflect.TypeOf(time.Time{})
+	bytesType   = reflect.TypeOf([]byte(nil))
+)
+
+func assign(field reflect.Value, data interface{}) error {
+	if field.Addr().Type().Implements(scannerType) {
+		return field.Addr().Interface().(sql.Scanner).Scan(data)
+	}
+
+	if data == nil {
+		field.Set(reflect.Zero(field.Type()))
+		return nil
+	}
+
+	if field.Kind() == reflect.Ptr {
+		elem := reflect.New(field.Type().Elem())
+		if err := assign(elem.Elem(), data); err != nil {
+			return err
+		}
+		field.Set(elem)
+		return nil
+	}
+
+	if field.Type() == timeType {
+		t, err := toTime(data)
+		if err != nil {
+			return err
+		}
+		field.Set(reflect.ValueOf(t))
+		return nil
+	}
+
+	switch field.Kind() {
+	case reflect.Bool:
+		b, err := toBool(data)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+		return nil
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, ok := data.(int64)
+		if !ok {
+			return cannotAssign(data, field)
+		}
+		if field.OverflowInt(i) {
+			return errors.Errorf("%d overflows %s", i, field.Type())
+		}
+		field.SetInt(i)
+		return nil
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		i, ok := data.(int64)
+		if !ok {
+			return cannotAssign(data, field)
+		}
+		if i < 0 || field.OverflowUint(uint64(i)) {
+			return errors.Errorf("%d overflows %s", i, field.Type())
+		}
+		field.SetUint(uint64(i))
+		return nil
+
+	case reflect.Float32, reflect.Float64:
+		switch v := data.(type) {
+		case float64:
+			field.SetFloat(v)
+		case int64:
+			field.SetFloat(float64(v))
+		default:
+			return cannotAssign(data, field)
+		}
+		return nil
+
+	case reflect.String:
+		switch v := data.(type) {
+		case string:
+			field.SetString(v)
+		case []byte:
+			field.SetString(string(v))
+		default:
+			return cannotAssign(data, field)
+		}
+		return nil
+	}
+
+	if field.Type() == bytesType {
+		switch v := data.(type) {
+		case []byte:
+			field.SetBytes(append([]byte(nil), v...))
+		case string:
+			field.SetBytes([]byte(v))
+		default:
+			return cannotAssign(data, field)
+		}
+		return nil
+	}
+
+	dataValue := reflect.ValueOf(data)
+	if !dataValue.Type().AssignableTo(field.Type()) {
+		return cannotAssign(data, field)
+	}
+	field.Set(dataValue)
+	return nil
+}
+
+func toTime(data interface{}) (time.Time, error) {
+	var s string
+	switch v := data.(type) {
+	case time.Time:
+		return v, nil
+	case string:
+		s = v
+	case []byte:
+		s = string(v)
+	default:
+		return time.Time{}, errors.Errorf("can not read a time from %T", data)
+	}
+
+	return db.ParseTimestamp(s)
+}
+
+func toBool(data interface{}) (bool, error) {
+	switch v := data.(type) {
+	case bool:
+		return v, nil
+	case int64:
+		return v != 0, nil
+	case string:
+		return strconv.ParseBool(v)
+	case []byte:
+		return strconv.ParseBool(string(v))
+	default:
+		return false, errors.Errorf("can not read a boolean from %T", data)
+	}
+}
+
+func cannotAssign(data interface{}, field reflect.Value) error {
+	return errors.Errorf("can not assign %T to %s", data, field.Type())
+}
@@ -2,41 +2,65 @@ package watcher
 
 import (
 	"database/sql"
+	"fmt"
+	"strings"
 
 	"github.com/SimonRichardson/nu-juju-watchers/db"
 	"github.com/SimonRichardson/nu-juju-watchers/eventqueue"
 	"gopkg.in/tomb.v2"
 )
 
-type EventQueue interface {
-	Subscribe(opts ...eventqueue.SubscriptionOption) (eventqueue.Subscription, error)
-}
-
 type ModelConfigValue struct {
 	ID    int64
 	Key   string
 	Value string
 }
 
+// ModelConfigChange is what happened to a model config value. The value of a
+// removal is the last one known.
+type ModelConfigChange struct {
+	Kind  ChangeKind
+	Value ModelConfigValue
+}
+
 type ModelConfigWatcher struct {
 	tomb       tomb.Tomb
 	db         *sql.DB
 	eventQueue EventQueue
-	out        chan []ModelConfigValue
+	out        chan []ModelConfigChange
+
+	// keys limits the watcher to the values of the keys, if there are any.
+	keys []string
 }
 
 func NewModelConfigWatcher(db *sql.DB, eventQueue EventQueue) *ModelConfigWatcher {
 	watcher := &ModelConfigWatcher{
 		db:         db,
 		eventQueue: eventQueue,
-		out:        make(chan []ModelConfigValue),
+		out:        make(chan []ModelConfigChange),
+	}
+	watcher.tomb.Go(watcher.loop)
+
+	return watcher
+}
+
+// NewModelConfigKeyValueWatcher watches the values of the model config keys
+// only. Its first event holds the current values of the keys, and is sent even
+// if none of them are set. After that, it only fires when one of the keys is
+// created, changes value or is removed. Without any keys, it watches them all.
+func NewModelConfigKeyValueWatcher(db *sql.DB, eventQueue EventQueue, keys ...string) *ModelConfigWatcher {
+	watcher := &ModelConfigWatcher{
+		db:         db,
+		eventQueue: eventQueue,
+		out:        make(chan []ModelConfigChange),
+		keys:       keys,
 	}
 	watcher.tomb.Go(watcher.loop)
 
 	return watcher
 }
 
-func (w *ModelConfigWatcher) Changes() <-chan []ModelConfigValue {
+func (w *ModelConfigWatcher) Changes() <-chan []ModelConfigChange {
 	return w.out
 }
 
@@ -50,23 +74,30 @@ func (w *ModelConfigWatcher) Close() error {
 }
 
 func (w *ModelConfigWatcher) loop() error {
-	subscription, err := w.eventQueue.Subscribe(eventqueue.Topic("model_config", eventqueue.Create|eventqueue.Update|eventqueue.Delete))
-	if err != nil {
-		return err
+	// Get the initial config, along with the change it is up to date with.
+	// Everything after it is replayed, so nothing is missed in between.
+	var values []ModelConfigValue
+	readInitial := func() (int64, error) {
+		var head int64
+		err := db.WithRetry(func() error {
+			var err error
+			values, head, err = w.initial()
+			return err
+		})
+		return head, err
 	}
-	defer subscription.Close()
-
-	// Get the initial config.
-	result, err := db.WithRetryWithResult(func() (interface{}, error) { return w.initial() })
+	subscription, err := subscribeAfter(&w.tomb, w.eventQueue, readInitial, w.topic(), eventqueue.Batched())
 	if err != nil {
 		return err
 	}
-	changes := result.([]ModelConfigValue)
+	defer subscription.Close()
 
-	store := make(map[int64]ModelConfigValue)
-	if len(changes) > 0 {
-		for _, change := range changes {
-			store[change.ID] = change
+	store := make(map[string]ModelConfigValue)
+	if len(values) > 0 || len(w.keys) > 0 {
+		changes := make([]ModelConfigChange, len(values))
+		for i, value := range values {
+			store[value.Key] = value
+			changes[i] = ModelConfigChange{Kind: Added, Value: value}
 		}
 
 		// Push initial changes out.
@@ -82,33 +113,24 @@ func (w *ModelConfigWatcher) loop() error {
 		case <-w.tomb.Dying():
 			return tomb.ErrDying
 
-		case c, ok := <-subscription.Changes():
+		case batch, ok := <-subscription.Batches():
 			if !ok {
-				return nil
+				return subscriptionEnded(&w.tomb, subscription)
 			}
 
 			// Modifications can be create or update.
 			var modifications []ModelConfigValue
-			var deletions map[int64]struct{}
+			var deletions map[string]struct{}
 			err := db.WithRetry(func() error {
 				var err error
-				modifications, deletions, err = w.updates(c)
+				modifications, deletions, err = w.updates(batch)
 				return err
 			})
 			if err != nil {
 				return err
 			}
 
-			changes := diffStoreChanges(store, modifications)
-
-			// Store the changes.
-			for _, v := range changes {
-				store[v.ID] = v
-			}
-			for id := range deletions {
-				delete(store, id)
-			}
-
+			changes := diffStoreChanges(store, modifications, deletions)
 			if len(changes) == 0 {
 				continue
 			}
@@ -123,32 +145,87 @@ func (w *ModelConfigWatcher) loop() error {
 	}
 }
 
-func diffStoreChanges(store map[int64]ModelConfigValue, changes []ModelConfigValue) []ModelConfigValue {
-	results := make([]ModelConfigValue, 0)
-	for _, change := range changes {
-		ch, ok := store[change.ID]
-		if ok && ch.Value == change.Value {
-			continue
+// diffStoreChanges applies the modifications and deletions to the store,
+// returning what changed.
+func diffStoreChanges(store map[string]ModelConfigValue, modifications []ModelConfigValue, deletions map[string]struct{}) []ModelConfigChange {
+	results := make([]ModelConfigChange, 0)
+	for _, value := range modifications {
+		kind := Added
+		if existing, ok := store[value.Key]; ok {
+			if existing.Value == value.Value {
+				continue
+			}
+			kind = Changed
 		}
 
-		results = append(results, change)
+		store[value.Key] = value
+		results = append(results, ModelConfigChange{Kind: kind, Value: value})
+	}
 
+	// Only the removal of a value we know about is news.
+	for key := range deletions {
+		value, ok := store[key]
+		if !ok {
+			continue
+		}
+
+		delete(store, key)
+		results = append(results, ModelConfigChange{Kind: Removed, Value: value})
 	}
 	return results
 }
 
 const (
-	modelConfigQuery    = "SELECT id, key, value FROM model_config WHERE id = ?"
+	modelConfigQuery    = "SELECT id, key, value FROM model_config WHERE key IN (%s)"
 	modelConfigQueryAll = "SELECT id, key, value FROM model_config"
+	changeLogHeadQuery  = "SELECT COALESCE(MAX(id), 0) FROM change_log"
 )
 
-func (w *ModelConfigWatcher) initial() ([]ModelConfigValue, error) {
-	rows, err := w.db.Query(modelConfigQueryAll)
+// topic matches every model config change, or only the changes to the keys
+// being watched.
+func (w *ModelConfigWatcher) topic() eventqueue.SubscriptionOption {
+	mask := eventqueue.Create | eventqueue.Update | eventqueue.Delete
+	if len(w.keys) == 0 {
+		return eventqueue.Topic("model_config", mask)
+	}
+
+	// The entity IDs of the model config are its keys.
+	return eventqueue.FilterTopic("model_config", mask, eventqueue.Filter{
+		EntityIDs: w.keys,
+	})
+}
+
+// modelConfigKeysQuery returns the query for the rows of the keys.
+func modelConfigKeysQuery(keys []string) (string, []interface{}) {
+	args := make([]interface{}, len(keys))
+	for i, key := range keys {
+		args[i] = key
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(keys)), ",")
+	return fmt.Sprintf(modelConfigQuery, placeholders), args
+}
+
+func (w *ModelConfigWatcher) initial() ([]ModelConfigValue, int64, error) {
+	// Read the config and the change_log head in the same transaction, so
+	// they agree with each other.
+	txn, err := w.db.Begin()
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return nil, nil
-		}
-		return nil, err
+		return nil, 0, err
+	}
+	defer func() { _ = txn.Rollback() }()
+
+	var head int64
+	if err := txn.QueryRow(changeLogHeadQuery).Scan(&head); err != nil {
+		return nil, 0, err
+	}
+
+	query, args := modelConfigQueryAll, []interface{}(nil)
+	if len(w.keys) > 0 {
+		query, args = modelConfigKeysQuery(w.keys)
+	}
+	rows, err := txn.Query(query, args...)
+	if err != nil {
+		return nil, 0, err
 	}
 	defer rows.Close()
 
@@ -163,28 +240,66 @@ func (w *ModelConfigWatcher) initial() ([]ModelConfigValue, error) {
 	}
 	for i := 0; rows.Next(); i++ {
 		if err := rows.Scan(dest(i)...); err != nil {
-			return nil, err
+			return nil, 0, err
 		}
 	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
 
-	return docs, nil
+	return docs, head, nil
 }
 
-func (w *ModelConfigWatcher) updates(change eventqueue.Change) ([]ModelConfigValue, map[int64]struct{}, error) {
-	if (change.Type() & eventqueue.Delete) != 0 {
-		return nil, map[int64]struct{}{change.EntityID(): {}}, nil
-	}
+// updates reads the current values of the keys changed by the batch. A key is
+// only deleted if its row has gone, as the batch can hold a delete followed by
+// a create of the same key.
+func (w *ModelConfigWatcher) updates(changes []eventqueue.Change) ([]ModelConfigValue, map[string]struct{}, error) {
+	// Every key starts out deleted, until its row is found.
+	deletions := make(map[string]struct{})
 
-	row := w.db.QueryRow(modelConfigQuery, change.EntityID())
+	var keys []string
+	for _, change := range changes {
+		if _, ok := deletions[change.EntityID()]; ok {
+			continue
+		}
+		deletions[change.EntityID()] = struct{}{}
+		keys = append(keys, change.EntityID())
+	}
+	if len(keys) == 0 {
+		return nil, deletions, nil
+	}
 
-	var doc ModelConfigValue
-	err := row.Scan(&doc.ID, &doc.Key, &doc.Value)
+	// Load the rows of all the keys in one go.
+	query, args := modelConfigKeysQuery(keys)
+	rows, err := w.db.Query(query, args...)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return nil, nil, nil
+			return nil, deletions, nil
 		}
 		return nil, nil, err
 	}
+	defer rows.Close()
 
-	return []ModelConfigValue{doc}, nil, nil
+	var docs []ModelConfigValue
+	dest := func(i int) []interface{} {
+		docs = append(docs, ModelConfigValue{})
+		return []interface{}{
+			&docs[i].ID,
+			&docs[i].Key,
+			&docs[i].Value,
+		}
+	}
+	for i := 0; rows.Next(); i++ {
+		if err := rows.Scan(dest(i)...); err != nil {
+			return nil, nil, err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	for _, doc := range docs {
+		delete(deletions, doc.Key)
+	}
+	return docs, deletions, nil
 }
@@ -0,0 +1,78 @@
+package watcher
+
+import (
+	"github.com/SimonRichardson/nu-juju-watchers/eventqueue"
+	"gopkg.in/tomb.v2"
+)
+
+// NewModelConfigNotifyWatcher notifies of any change to the model config.
+func NewModelConfigNotifyWatcher(eventQueue EventQueue) *NotifyWatcher {
+	return NewNotifyWatcher(eventQueue,
+		eventqueue.Topic("model_config", eventqueue.Create|eventqueue.Update|eventqueue.Delete),
+	)
+}
+
+// NotifyWatcher notifies that something has changed, without saying what.
+//
+// The first event is always sent, so the consumer reads the current state.
+// After that, every change made before the consumer reads the next event is
+// coalesced into it.
+type NotifyWatcher struct {
+	tomb       tomb.Tomb
+	eventQueue EventQueue
+	topics     []eventqueue.SubscriptionOption
+	out        chan struct{}
+}
+
+// NewNotifyWatcher notifies of the changes matching the topics.
+func NewNotifyWatcher(eventQueue EventQueue, topics ...eventqueue.SubscriptionOption) *NotifyWatcher {
+	watcher := &NotifyWatcher{
+		eventQueue: eventQueue,
+		topics:     topics,
+		out:        make(chan struct{}),
+	}
+	watcher.tomb.Go(watcher.loop)
+
+	return watcher
+}
+
+func (w *NotifyWatcher) Changes() <-chan struct{} {
+	return w.out
+}
+
+func (w *NotifyWatcher) Wait() <-chan struct{} {
+	return w.tomb.Dead()
+}
+
+func (w *NotifyWatcher) Close() error {
+	w.tomb.Kill(nil)
+	return w.tomb.Wait()
+}
+
+func (w *NotifyWatcher) loop() error {
+	// Subscribe before the initial event, so no change after the consumer
+	// reads the state goes unnoticed.
+	opts := append([]eventqueue.SubscriptionOption{eventqueue.Batched()}, w.topics...)
+	subscription, err := w.eventQueue.Subscribe(w.tomb.Context(nil), opts...)
+	if err != nil {
+		return err
+	}
+	defer subscription.Close()
+
+	out := w.out
+	for {
+		select {
+		case <-w.tomb.Dying():
+			return tomb.ErrDying
+
+		case _, ok := <-subscription.Batches():
+			if !ok {
+				return subscriptionEnded(&w.tomb, subscription)
+			}
+			out = w.out
+
+		case out <- struct{}{}:
+			out = nil
+		}
+	}
+}
@@ -5,29 +5,26 @@ import (
 
 	"github.com/SimonRichardson/nu-juju-watchers/db"
 	"github.com/SimonRichardson/nu-juju-watchers/eventqueue"
+	"github.com/juju/collections/set"
 	"gopkg.in/tomb.v2"
 )
 
 const (
-	stringsQuery    = "SELECT key FROM model_config WHERE id = ?"
 	stringsQueryAll = "SELECT key FROM model_config"
 )
 
+// NewModelConfigKeyWatcher watches the keys of the model config.
 func NewModelConfigKeyWatcher(db *sql.DB, eventQueue EventQueue) *StringsWatcher {
-	watcher := &StringsWatcher{
-		db:         db,
-		eventQueue: eventQueue,
-		out:        make(chan []string),
-
-		tableName: "model_config",
-		query:     stringsQuery,
-		queryAll:  stringsQueryAll,
-	}
-	watcher.tomb.Go(watcher.loop)
-
-	return watcher
+	return NewStringsWatcher(db, eventQueue, "model_config", stringsQueryAll)
 }
 
+// StringsWatcher reports the entity IDs of the entities of a table that are
+// created, updated or deleted.
+//
+// The first event always holds the IDs of every entity there is, even if
+// there are none. After that, the IDs of the entities that changed are merged
+// together until the consumer reads them, so an event never holds the same ID
+// twice and is never empty.
 type StringsWatcher struct {
 	tomb       tomb.Tomb
 	db         *sql.DB
@@ -35,10 +32,25 @@ type StringsWatcher struct {
 	out        chan []string
 
 	tableName string
-	query     string
 	queryAll  string
 }
 
+// NewStringsWatcher watches the entities of the table. The query selects
+// the IDs of every entity, as the change_log has them.
+func NewStringsWatcher(db *sql.DB, eventQueue EventQueue, tableName, queryAll string) *StringsWatcher {
+	watcher := &StringsWatcher{
+		db:         db,
+		eventQueue: eventQueue,
+		out:        make(chan []string),
+
+		tableName: tableName,
+		queryAll:  queryAll,
+	}
+	watcher.tomb.Go(watcher.loop)
+
+	return watcher
+}
+
 func (w *StringsWatcher) Changes() <-chan []string {
 	return w.out
 }
@@ -53,81 +65,112 @@ func (w *StringsWatcher) Close() error {
 }
 
 func (w *StringsWatcher) loop() error {
-	subscription, err := w.eventQueue.Subscribe(eventqueue.Topic(w.tableName, eventqueue.Create|eventqueue.Update|eventqueue.Delete))
-	if err != nil {
-		return err
+	var initial []string
+	readInitial := func() (int64, error) {
+		var head int64
+		err := db.WithRetry(func() error {
+			var err error
+			initial, head, err = w.initial()
+			return err
+		})
+		return head, err
 	}
-	defer subscription.Close()
-
-	changes, err := w.initial()
+	subscription, err := subscribeAfter(&w.tomb, w.eventQueue, readInitial,
+		eventqueue.Topic(w.tableName, eventqueue.Create|eventqueue.Update|eventqueue.Delete),
+		eventqueue.Batched(),
+	)
 	if err != nil {
 		return err
 	}
+	defer subscription.Close()
 
+	// The initial event is sent even if it is empty.
+	pending := newPendingStrings(initial)
 	out := w.out
 	for {
 		select {
 		case <-w.tomb.Dying():
 			return tomb.ErrDying
-		case c, ok := <-subscription.Changes():
+
+		case batch, ok := <-subscription.Batches():
 			if !ok {
-				return nil
+				return subscriptionEnded(&w.tomb, subscription)
 			}
 
-			changes, err := w.updates(c)
-			if err != nil {
-				return err
+			for _, change := range batch {
+				pending.add(change.EntityID())
 			}
-
-			if len(changes) == 0 {
-				continue
+			if !pending.empty() {
+				out = w.out
 			}
 
-			out = w.out
-		case out <- changes:
+		case out <- pending.values:
+			pending = newPendingStrings(nil)
+			out = nil
 		}
 	}
 }
 
-func (w *StringsWatcher) initial() ([]string, error) {
-	var docs []string
-	err := db.WithRetry(func() error {
-		rows, err := w.db.Query(w.queryAll)
-		if err != nil {
-			if err == sql.ErrNoRows {
-				return nil
-			}
-			return err
-		}
-		defer rows.Close()
+// initial returns the IDs of every entity, along with the change they are up
+// to date with.
+func (w *StringsWatcher) initial() ([]string, int64, error) {
+	txn, err := w.db.Begin()
+	if err != nil {
+		return nil, 0, err
+	}
+	defer func() { _ = txn.Rollback() }()
 
-		for i := 0; rows.Next(); i++ {
-			docs = append(docs, "")
-			if err := rows.Scan(&docs[i]); err != nil {
-				return err
-			}
+	var head int64
+	if err := txn.QueryRow(changeLogHeadQuery).Scan(&head); err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := txn.Query(w.queryAll)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	var docs []string
+	for i := 0; rows.Next(); i++ {
+		docs = append(docs, "")
+		if err := rows.Scan(&docs[i]); err != nil {
+			return nil, 0, err
 		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
 
-		return nil
-	})
+	return docs, head, nil
+}
 
-	return docs, err
+// pendingStrings are the strings waiting for the consumer, in the order they
+// were first added.
+type pendingStrings struct {
+	values []string
+	seen   set.Strings
 }
 
-func (w *StringsWatcher) updates(change eventqueue.Change) ([]string, error) {
-	var doc string
-	err := db.WithRetry(func() error {
-		row := w.db.QueryRow(w.query, change.EntityID())
+func newPendingStrings(values []string) *pendingStrings {
+	p := &pendingStrings{
+		values: make([]string, 0, len(values)),
+		seen:   set.NewStrings(),
+	}
+	for _, value := range values {
+		p.add(value)
+	}
+	return p
+}
 
-		err := row.Scan(&doc)
-		if err != nil {
-			if err == sql.ErrNoRows {
-				return nil
-			}
-			return err
-		}
+func (p *pendingStrings) add(value string) {
+	if p.seen.Contains(value) {
+		return
+	}
+	p.seen.Add(value)
+	p.values = append(p.values, value)
+}
 
-		return nil
-	})
-	return []string{doc}, err
+func (p *pendingStrings) empty() bool {
+	return len(p.values) == 0
 }
@@ -0,0 +1,74 @@
+package watcher
+
+import (
+	"context"
+
+	"github.com/SimonRichardson/nu-juju-watchers/eventqueue"
+	"gopkg.in/tomb.v2"
+)
+
+type EventQueue interface {
+	Subscribe(ctx context.Context, opts ...eventqueue.SubscriptionOption) (eventqueue.Subscription, error)
+}
+
+// subscriptionEnded returns the error for the tomb of a watcher whose
+// subscription has ended; why the subscription ended, unless the watcher
+// itself is the reason.
+func subscriptionEnded(t *tomb.Tomb, subscription eventqueue.Subscription) error {
+	select {
+	case <-t.Dying():
+		return tomb.ErrDying
+	default:
+	}
+	return subscription.Err()
+}
+
+// subscribeAfter reads the initial state of a watcher with readFn, which
+// returns the change ID the state is up to date with, and subscribes to the
+// changes made after it. If the change stream of the queue can't replay the
+// changes, the subscription is made before the state is read again instead,
+// so nothing is missed, although the changes made in between may be
+// delivered even though the state already has them.
+func subscribeAfter(t *tomb.Tomb, eventQueue EventQueue, readFn func() (int64, error), opts ...eventqueue.SubscriptionOption) (eventqueue.Subscription, error) {
+	head, err := readFn()
+	if err != nil {
+		return nil, err
+	}
+
+	subscription, err := eventQueue.Subscribe(t.Context(nil), append(opts, eventqueue.SinceChangeID(head))...)
+	if err != eventqueue.ErrReplayUnsupported {
+		return subscription, err
+	}
+
+	subscription, err = eventQueue.Subscribe(t.Context(nil), opts...)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := readFn(); err != nil {
+		_ = subscription.Close()
+		return nil, err
+	}
+	return subscription, nil
+}
+
+// ChangeKind is what happened to an entity a watcher reports on.
+type ChangeKind int
+
+const (
+	Added ChangeKind = iota + 1
+	Changed
+	Removed
+)
+
+func (k ChangeKind) String() string {
+	switch k {
+	case Added:
+		return "added"
+	case Changed:
+		return "changed"
+	case Removed:
+		return "removed"
+	default:
+		return "unknown"
+	}
+}